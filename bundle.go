@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// writeBundle zips files, by base name, into path. Entries carry the
+// SOURCE_DATE_EPOCH (or zero) time so the bundle is as reproducible as its
+// contents. With keepTemp a partial path.tmp is left behind on failure.
+func writeBundle(path string, files []string, modified time.Time, keepTemp bool) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if !keepTemp {
+		defer os.Remove(tmp)
+	}
+
+	zw := zip.NewWriter(f)
+	for _, name := range files {
+		if err := addToBundle(zw, name, modified); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func addToBundle(zw *zip.Writer, name string, modified time.Time) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	hdr := &zip.FileHeader{
+		Name:     filepath.Base(name),
+		Method:   zip.Deflate,
+		Modified: modified,
+	}
+	hdr.SetMode(0o644)
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
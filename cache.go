@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/chapmanjacobd/mkmetalink/metalink"
+)
+
+// hashTree is metalink.HashFiles with --checksum-cache, which also returns
+// the number of bytes whose hashes came from the cache
+func (c *GenerateCmd) hashTree(tree metalink.Tree, opts metalink.Options) ([]metalink.FileHashResult, metalink.TorrentPieces, int64, error) {
+	if c.ChecksumCache == "" {
+		results, pieces, err := metalink.HashFiles(tree, opts)
+		return results, pieces, 0, err
+	}
+	cache, err := metalink.LoadHashCache(c.ChecksumCache)
+	if err != nil {
+		return nil, metalink.TorrentPieces{}, 0, fmt.Errorf("checksum-cache: %w", err)
+	}
+	results, missing := cache.Lookup(tree, opts)
+	pieces, havePieces := cache.Pieces(tree, opts)
+	// Verify compares against the torrent pieces, so it needs all of them
+	partial := c.HTTPOnly && !c.VerifyAfterGenerate
+
+	var cachedBytes int64
+	switch {
+	case len(missing) == 0 && (havePieces || partial):
+		fmt.Printf("All %d files are unchanged since they were cached\n", len(tree.Files))
+		cachedBytes = tree.Total
+	case partial:
+		sub := tree
+		sub.Files = nil
+		sub.Total = 0
+		for _, i := range missing {
+			sub.Files = append(sub.Files, tree.Files[i])
+			sub.Total += tree.Files[i].Size
+		}
+		cachedBytes = tree.Total - sub.Total
+		sizeBase := 1024.0
+		if c.SizeUnits == "si" {
+			sizeBase = 1000
+		}
+		fmt.Printf("Reusing the cached hashes of %d unchanged files (%s)\n", len(tree.Files)-len(missing), metalink.FormatBytes(cachedBytes, sizeBase))
+		subResults, _, err := metalink.HashFiles(sub, opts)
+		if err != nil {
+			return nil, metalink.TorrentPieces{}, 0, err
+		}
+		for j, i := range missing {
+			results[i] = subResults[j]
+		}
+	default:
+		results, pieces, err = metalink.HashFiles(tree, opts)
+		if err != nil {
+			return nil, metalink.TorrentPieces{}, 0, err
+		}
+	}
+
+	if partial {
+		cache.Update(tree, results, nil, opts)
+	} else {
+		cache.Update(tree, results, &pieces, opts)
+	}
+	if err := cache.Save(c.ChecksumCache); err != nil {
+		return nil, metalink.TorrentPieces{}, 0, fmt.Errorf("checksum-cache: %w", err)
+	}
+	return results, pieces, cachedBytes, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chapmanjacobd/mkmetalink/metalink"
+)
+
+type CompareCmd struct {
+	Old  string `arg:"" help:"Earlier .meta4" type:"existingfile"`
+	New  string `arg:"" help:"Later .meta4" type:"existingfile"`
+	JSON bool   `help:"Print the differences as JSON" name:"json"`
+}
+
+func (c *CompareCmd) Run() error {
+	a, err := metalink.ReadMetaFile(c.Old)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.Old, err)
+	}
+	b, err := metalink.ReadMetaFile(c.New)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.New, err)
+	}
+	aTor, err := metalink.MetalinkTorrent(a, c.Old)
+	if err != nil {
+		return fmt.Errorf("%s torrent: %w", c.Old, err)
+	}
+	bTor, err := metalink.MetalinkTorrent(b, c.New)
+	if err != nil {
+		return fmt.Errorf("%s torrent: %w", c.New, err)
+	}
+
+	d := metalink.CompareMetalinks(a, b, aTor, bTor)
+	if c.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+
+	if d.Empty() {
+		fmt.Println("No differences")
+		return nil
+	}
+	for _, name := range d.Added {
+		fmt.Printf("added    %s\n", name)
+	}
+	for _, name := range d.Removed {
+		fmt.Printf("removed  %s\n", name)
+	}
+	for _, ch := range d.Changed {
+		fmt.Printf("changed  %s (%d -> %d bytes)\n", ch.Name, ch.OldSize, ch.NewSize)
+	}
+	for _, r := range d.Renamed {
+		fmt.Printf("renamed  %s -> %s\n", r.From, r.To)
+	}
+	if d.OldPieceSize != nil || d.NewPieceSize != nil {
+		fmt.Printf("piece size %s -> %s\n", formatSizes(d.OldPieceSize), formatSizes(d.NewPieceSize))
+	}
+	if d.OldTrackers != nil || d.NewTrackers != nil {
+		fmt.Printf("trackers %s -> %s\n", strings.Join(d.OldTrackers, ", "), strings.Join(d.NewTrackers, ", "))
+	}
+	return nil
+}
+
+func formatSizes(sizes []int64) string {
+	if len(sizes) == 0 {
+		return "none"
+	}
+	parts := make([]string, len(sizes))
+	for i, s := range sizes {
+		parts[i] = metalink.FormatBytes(s, 1024)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	kongtoml "github.com/alecthomas/kong-toml"
+)
+
+const envPrefix = "MKMETALINK_"
+
+// configPaths lists config files from lowest to highest precedence: the
+// user's config, then mkmetalink.toml in the working directory
+func configPaths() []string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = "~/.config"
+	}
+	return []string{
+		filepath.Join(dir, "mkmetalink", "mkmetalink.toml"),
+		"mkmetalink.toml",
+	}
+}
+
+// envResolver reads flags from MKMETALINK_<FLAG_NAME> variables. It is added
+// after the config files so the environment overrides them; flags given on
+// the command line are never resolved.
+var envResolver kong.ResolverFunc = func(_ *kong.Context, _ *kong.Path, flag *kong.Flag) (any, error) {
+	name := envPrefix + strings.ToUpper(strings.ReplaceAll(flag.Name, "-", "_"))
+	if v, ok := os.LookupEnv(name); ok {
+		return v, nil
+	}
+	return nil, nil
+}
+
+func configOptions() []kong.Option {
+	return []kong.Option{
+		kong.Configuration(kongtoml.Loader, configPaths()...),
+		kong.Resolvers(envResolver),
+	}
+}
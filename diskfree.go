@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chapmanjacobd/mkmetalink/metalink"
+)
+
+// estimateOutputSize roughly sizes the metalink and torrent of tree, which
+// for large trees are mostly piece hashes: about 80 bytes for each hex SHA-256
+// <hash> of the metalink, and 20 bytes for each SHA-1 piece of the torrent
+func (c *GenerateCmd) estimateOutputSize(tree metalink.Tree, pieceSize int64) (meta, torrent int64) {
+	files := int64(len(tree.Files))
+	// Per-file pieces end at each file's end
+	pieces := (tree.Total+pieceSize-1)/pieceSize + files
+
+	if !c.PiecesInTorrentOnly {
+		meta += pieces * 80 * int64(len(c.PieceHash))
+		for _, size := range c.ExtraPieceSize {
+			meta += (tree.Total/int64(size) + files) * 80
+		}
+	}
+	for _, fi := range tree.Files {
+		name := int64(len(fi.RelPath))
+		meta += 300 + name + int64(len(c.Mirrors))*(name+100)
+		torrent += 40 + name
+	}
+	if !c.HTTPOnly {
+		torrent += pieces * 20
+	}
+	if c.EmbedTorrent {
+		meta += torrent * 4 / 3
+	}
+	return meta, torrent
+}
+
+// checkDiskFree stops a run that would fill up an output directory's
+// filesystem, before the hashing rather than at the final write
+func (c *GenerateCmd) checkDiskFree(tree metalink.Tree, pieceSize int64, sizeBase float64) error {
+	meta, torrent := c.estimateOutputSize(tree, pieceSize)
+	need := map[string]int64{c.metaOutDir(): meta}
+	need[c.torrentOutDir()] += torrent
+
+	for dir, size := range need {
+		// The output directory may not have been created yet
+		existing := dir
+		for {
+			if _, err := os.Stat(existing); err == nil || !errors.Is(err, os.ErrNotExist) || filepath.Dir(existing) == existing {
+				break
+			}
+			existing = filepath.Dir(existing)
+		}
+		free, ok := diskFree(existing)
+		if !ok {
+			continue
+		}
+		if free < size+int64(c.MinDiskFree) {
+			return fmt.Errorf("%s has %s free, but the artifacts need about %s plus --min-disk-free %s", dir, metalink.FormatBytes(free, sizeBase), metalink.FormatBytes(size, sizeBase), metalink.FormatBytes(int64(c.MinDiskFree), sizeBase))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// diskFree isn't implemented here, so the free space isn't checked
+func diskFree(path string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,25 @@
+package main
+
+// Exit statuses, for scripts that need to tell why a run failed (see the
+// README). A failed --after command passes on its own status instead.
+const (
+	exitFailure = 1 // anything else, such as an unreadable file
+	exitUsage   = 2 // invalid flags or arguments
+	exitVerify  = 3 // --verify-after-generate read different content
+	exitSign    = 4 // gpg is missing, has no key or failed
+)
+
+// exitError gives err an exit status other than exitFailure, through
+// kong.ExitCoder
+type exitError struct {
+	err  error
+	code int
+}
+
+func (e exitError) Error() string { return e.err.Error() }
+func (e exitError) Unwrap() error { return e.err }
+func (e exitError) ExitCode() int { return e.code }
+
+func usageError(err error) error {
+	return exitError{err, exitUsage}
+}
@@ -4,5 +4,8 @@ go 1.25.1
 
 require (
 	github.com/alecthomas/kong v1.12.1
+	github.com/alecthomas/kong-toml v0.4.0
 	github.com/jackpal/bencode-go v1.0.2
 )
+
+require github.com/pelletier/go-toml v1.9.5 // indirect
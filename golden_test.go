@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chapmanjacobd/mkmetalink/metalink"
+)
+
+var update = flag.Bool("update", false, "write the golden files in testdata/golden instead of comparing with them")
+
+// goldenFixture is a package whose artifacts are compared byte for byte with
+// the files under testdata/golden
+type goldenFixture struct {
+	name  string
+	files map[string]int // sizes by relative path; nil for a single file
+	size  int
+}
+
+var goldenFixtures = []goldenFixture{
+	{name: "single.bin", size: 3*selftestPieceSize + 5},
+	{name: "dir", files: map[string]int{
+		"a.txt":       100,
+		"empty":       0,
+		"sub/b.bin":   2*selftestPieceSize - 1,
+		"sub/c/d.bin": selftestPieceSize,
+	}},
+	{name: "empty", size: 0},
+}
+
+func goldenData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size) + 1)).Read(data)
+	return data
+}
+
+// TestGolden generates each fixture and compares the .meta4, .torrent and
+// infohash with the golden files. After an intended output change, rewrite
+// them with go test -run Golden -update and review the diff.
+func TestGolden(t *testing.T) {
+	// Timestamps would make the output differ from run to run
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	for _, fx := range goldenFixtures {
+		t.Run(fx.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src", fx.name)
+			if fx.files == nil {
+				writeGoldenSource(t, src, fx.size)
+			}
+			for rel, size := range fx.files {
+				writeGoldenSource(t, filepath.Join(src, filepath.FromSlash(rel)), size)
+			}
+
+			out := filepath.Join(dir, "out")
+			gen := GenerateCmd{
+				Path:       src,
+				OutDir:     out,
+				Tracker:    "https://tracker.example.com/announce",
+				Mirrors:    []string{"https://example.com/pub/"},
+				PieceSize:  selftestPieceSize,
+				ReadBuffer: 10007,
+				SizeUnits:  "iec",
+				SignTarget: "metalink",
+				PieceHash:  []string{"sha-256"},
+			}
+			if err := gen.Run(); err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+
+			tor, err := metalink.ReadTorrentFile(filepath.Join(out, fx.name+".torrent"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ih, err := metalink.InfoHash(tor.Info)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, ext := range []string{".meta4", ".torrent", ".infohash"} {
+				got := []byte(hex.EncodeToString(ih) + "\n")
+				if ext != ".infohash" {
+					got, err = os.ReadFile(filepath.Join(out, fx.name+ext))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				golden := filepath.Join("testdata", "golden", fx.name+ext)
+				if *update {
+					if err := os.WriteFile(golden, got, 0o644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v (run go test -run Golden -update)", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s differs from %s from byte %d", fx.name+ext, golden, firstDifference(got, want))
+				}
+			}
+		})
+	}
+}
+
+func writeGoldenSource(t *testing.T, path string, size int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, goldenData(size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// firstDifference is the offset where got first departs from want
+func firstDifference(got, want []byte) int {
+	i := 0
+	for i < min(len(got), len(want)) && got[i] == want[i] {
+		i++
+	}
+	return i
+}
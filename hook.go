@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// afterPlaceholders are the {names} --after substitutes, in the order
+// listed in the help
+var afterPlaceholders = []string{"meta", "torrent", "infohash", "name", "bundle"}
+
+// runAfter runs the --after command with the placeholders in vars
+// substituted. The command is split into arguments before substituting, so
+// paths with spaces stay one argument.
+func (c *GenerateCmd) runAfter(vars map[string]string) error {
+	args, err := splitArgs(c.After)
+	if err != nil {
+		return fmt.Errorf("after: %w", err)
+	}
+	var pairs []string
+	for _, name := range afterPlaceholders {
+		pairs = append(pairs, "{"+name+"}", vars[name])
+	}
+	r := strings.NewReplacer(pairs...)
+	for i := range args {
+		args[i] = r.Replace(args[i])
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = os.Environ()
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		// The exit code is passed on by main
+		return fmt.Errorf("after: %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// checkAfter rejects --after commands that can't run or that use a
+// placeholder with no value in this configuration
+func (c *GenerateCmd) checkAfter() error {
+	args, err := splitArgs(c.After)
+	if err != nil {
+		return fmt.Errorf("after: %w", err)
+	}
+	if len(args) == 0 {
+		return errors.New("after: empty command")
+	}
+	uses := func(name string) bool { return strings.Contains(c.After, "{"+name+"}") }
+	switch {
+	case c.HTTPOnly && (uses("torrent") || uses("infohash")):
+		return errors.New("after: {torrent} and {infohash} have no value with --http-only")
+	case c.Bundle == "" && uses("bundle"):
+		return errors.New("after: {bundle} needs --bundle")
+	case c.BundleOnly && (uses("meta") || uses("torrent")):
+		return errors.New("after: --bundle-only removes the files {meta} and {torrent} name; use {bundle}")
+	}
+	return nil
+}
+
+// splitArgs splits s into arguments at unquoted spaces. Single and double
+// quotes group words, without any escapes; anything more needs sh -c.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
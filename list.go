@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/chapmanjacobd/mkmetalink/metalink"
+)
+
+type ListCmd struct {
+	WalkFlags `embed:""`
+
+	OutDir    string `help:"Output directory generate would use, so that its artifacts are recognized and skipped" short:"o" optional:""`
+	SizeUnits string `help:"Units for the total on stderr: iec (KiB, base 1024) or si (KB, base 1000)" enum:"iec,si" default:"iec"`
+
+	Path string `arg:"" help:"File or directory to list" type:"path"`
+}
+
+// Run prints "relpath<TAB>bytes" lines in package order on stdout and the
+// total on stderr, so the list can be piped on its own
+func (c *ListCmd) Run() error {
+	gen := GenerateCmd{WalkFlags: c.WalkFlags, OutDir: c.OutDir, Path: c.Path}
+	opts := metalink.Options{Logf: log.Printf}
+	tree, err := gen.walkTree(&opts)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range tree.Files {
+		fmt.Printf("%s\t%d\n", fi.RelPath, fi.Size)
+	}
+
+	sizeBase := 1024.0
+	if c.SizeUnits == "si" {
+		sizeBase = 1000
+	}
+	fmt.Fprintf(os.Stderr, "%d files, %s\n", len(tree.Files), metalink.FormatBytes(tree.Total, sizeBase))
+	return nil
+}
@@ -1,590 +1,1440 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/xml"
+	"cmp"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"log"
-	"math"
+	"mime"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/alecthomas/kong"
-	"github.com/jackpal/bencode-go"
+	"github.com/chapmanjacobd/mkmetalink/metalink"
 )
 
-const (
-	P_MIN       = 256 * 1024
-	P_CAP       = 4 * 1024 * 1024
-	P_MAX       = 64 * 1024 * 1024
-	N_THRESHOLD = 7500
-	CHUNK_SIZE  = 32 * 1024 * 1024
-)
+// defaultTracker is the --tracker default; --from-torrent only replaces it
+// when it wasn't changed
+const defaultTracker = "https://privtracker.com/metalink/announce"
 
-func calculatePieceSize(total int64) int64 {
-	if total <= 0 {
-		return P_MIN
-	}
+// maxFilesPerPiece is the average piece span above which generate suggests a
+// smaller piece size
+const maxFilesPerPiece = 4
 
-	logExp := math.Floor(math.Log2(float64(total)) - 10)
-	baseLog := int64(math.Max(float64(P_MIN), math.Pow(2, logExp)))
-	current := baseLog
-	if current > P_CAP {
-		current = P_CAP
-	}
+// ByteSize is a kong flag type that accepts human-readable sizes
+type ByteSize int64
 
-	currentPieces := float64(total) / float64(current)
-	if currentPieces > N_THRESHOLD {
-		target := float64(total) / N_THRESHOLD
-		stepped := int64(math.Pow(2, math.Floor(math.Log2(target))))
-		if stepped < P_CAP {
-			stepped = P_CAP
-		}
-		if stepped > P_MAX {
-			stepped = P_MAX
-		}
-		current = stepped
+func (b *ByteSize) Decode(ctx *kong.DecodeContext) error {
+	// Config files may give sizes as plain numbers
+	token, err := ctx.Scan.PopValue("size")
+	if err != nil {
+		return err
 	}
-
-	if current < P_MIN {
-		current = P_MIN
+	var s string
+	switch v := token.Value.(type) {
+	case string:
+		s = v
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Errorf("expected a size but got %v", token.Value)
+	}
+	n, err := metalink.ParseSize(s)
+	if err != nil {
+		return err
 	}
-	return current
+	*b = ByteSize(n)
+	return nil
 }
 
-func formatBytes(b int64) string {
-	if b == 0 {
-		return "0 B"
+// FileMode is a kong flag type for octal permissions such as 0640
+type FileMode os.FileMode
+
+func (m *FileMode) Decode(ctx *kong.DecodeContext) error {
+	token, err := ctx.Scan.PopValue("mode")
+	if err != nil {
+		return err
+	}
+	var s string
+	switch v := token.Value.(type) {
+	case string:
+		s = v
+	case int64:
+		// A config file's 640 means 0640
+		s = strconv.FormatInt(v, 10)
+	default:
+		return fmt.Errorf("expected a mode but got %v", token.Value)
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0o777 {
+		return fmt.Errorf("mode %q is not octal permissions like 0644", s)
 	}
+	*m = FileMode(n)
+	return nil
+}
 
-	size := float64(b)
-	base := 1024.0
-	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+// WalkFlags select the files to package. They are shared by generate and
+// list.
+type WalkFlags struct {
+	EmptyDirPlaceholder string `help:"Add a zero-byte file with this name to each empty directory so the directory survives in the metalink and torrent. Only the output is affected; nothing is written to the source tree or mirrors" placeholder:"NAME"`
 
-	i := math.Floor(math.Log(size) / math.Log(base))
+	RecordSymlinks bool `help:"Record symlinks to files inside the directory in the torrent as BEP-47 symlinks instead of skipping them. The metalink has no way to express them and leaves them out" name:"record-symlinks"`
 
-	// Bound the index
-	if i >= float64(len(units)) {
-		i = float64(len(units) - 1)
-	}
+	MinFileSize ByteSize `help:"Skip files smaller than this" placeholder:"SIZE"`
+	MaxFileSize ByteSize `help:"Skip files larger than this" placeholder:"SIZE"`
 
-	return fmt.Sprintf("%.1f %s", size/math.Pow(base, i), units[int(i)])
-}
+	IncludeArtifacts bool `help:"Package files that look like this tool's output (<name>.meta4, <name>.torrent, ... in the output directory) instead of skipping them" name:"include-artifacts"`
 
-// ---------- Metalink (RFC5854) XML structs ----------
+	ExcludeFrom string `help:"Skip paths matching the gitignore-style patterns in this file" type:"existingfile" optional:"" placeholder:"FILE"`
+	SortFilesBy string `help:"File order in both artifacts: name, size (largest first) or mtime (newest first)" enum:"name,size,mtime" default:"name"`
 
-type Metalink struct {
-	XMLName   xml.Name       `xml:"metalink"`
-	XMLNs     string         `xml:"xmlns,attr"`
-	Version   string         `xml:"version,attr,omitempty"`
-	Metaurls  []MetaURL      `xml:"metaurl,omitempty"`
-	Files     []MetalinkFile `xml:"file"`
-	Signature *MetaSignature `xml:"signature,omitempty"`
-}
+	ResolveLFS bool `help:"Package the content of Git LFS pointer files from the repository's .git/lfs/objects instead of the pointers themselves. Without it, pointer files only get a warning" name:"resolve-lfs"`
 
-type MetaURL struct {
-	Priority  int    `xml:"priority,attr,omitempty"`
-	MediaType string `xml:"mediatype,attr,omitempty"`
-	Value     string `xml:",chardata"`
-}
+	SanitizeNames bool `help:"Replace invalid UTF-8 and characters XML can't carry in file names with U+FFFD instead of failing. The files are still read from their real paths, but mirrors must serve them under the new names" name:"sanitize-names"`
 
-type MetalinkFile struct {
-	Name   string        `xml:"name,attr"`
-	Size   int64         `xml:"size"`
-	Hash   MetaHash      `xml:"hash"`
-	Pieces MetaPieces    `xml:"pieces"`
-	URLs   []MetalinkURL `xml:"url,omitempty"`
+	MaxFiles     int      `help:"Stop if the walk finds more files than this, as a guard against a mistyped path (0 for no limit)" placeholder:"N"`
+	MaxTotalSize ByteSize `help:"Stop if the files add up to more than this, as a guard against a mistyped path" placeholder:"SIZE"`
 }
 
-type MetaHash struct {
-	Type  string `xml:"type,attr"`
-	Value string `xml:",chardata"`
-}
+type GenerateCmd struct {
+	Sign    string   `help:"If set, pass this GPG --local-user (key id) to sign" optional:"" aliases:"pgp,gpg"`
+	Tracker string   `help:"Tracker URL for generated torrent's announce (default privtracker): http(s)://, udp:// or ws(s)://" default:"${default_tracker}"`
+	OutDir  string   `help:"Optional output directory for generated files. Default: input file's parent directory or input directory" short:"o" optional:""`
+	Mirrors []string `name:"mirrors" short:"m" help:"HTTPS mirrors (if directory: base URLs). Append |conns=N to hint a connection limit for one mirror"`
+	Merkle  bool     `help:"Emit a BEP-30 merkle torrent ('root hash' instead of 'pieces')"`
+	NoWrap  bool     `help:"For directories, list files at the metalink root instead of under the directory name (mirrors serve a flat layout). The torrent still names its root folder after the directory, as BEP 3 requires" name:"no-wrap"`
 
-type MetaPieces struct {
-	Type   string          `xml:"type,attr"`
-	Length int64           `xml:"length,attr"`
-	Hashes []MetaPieceHash `xml:"hash"`
-}
+	MetaOutDir    string `help:"Output directory for the metalink (and --external-pieces), overriding --out-dir" name:"meta-out-dir" placeholder:"DIR"`
+	TorrentOutDir string `help:"Output directory for the torrent, overriding --out-dir, e.g. a seedbox watch folder. The metalink refers to it by relative path" name:"torrent-out-dir" placeholder:"DIR"`
 
-type MetaPieceHash struct {
-	Type  string `xml:"type,attr,omitempty"`
-	Value string `xml:",chardata"`
-}
+	OutMode    FileMode `help:"Permissions of the generated files, e.g. 0640 for a web root served by a group (default: 0644 or as the umask allows)" name:"out-mode" placeholder:"MODE"`
+	OutDirMode FileMode `help:"Permissions of the output directories that have to be created (default: 0755 or as the umask allows)" name:"out-dir-mode" placeholder:"MODE"`
 
-type MetalinkURL struct {
-	Priority int    `xml:"priority,attr,omitempty"`
-	Value    string `xml:",chardata"`
-}
+	MinDiskFree ByteSize `help:"Space to leave free on the output filesystems besides the artifacts. Before hashing, the size of the metalink and torrent is estimated from the piece count and the run stops if they wouldn't fit" name:"min-disk-free" placeholder:"SIZE"`
 
-type MetaSignature struct {
-	Mediatype string `xml:"mediatype,attr"`
-	Value     string `xml:",chardata"`
-}
+	LegacyUTF8Name bool `help:"Repeat the torrent's name and file paths in name.utf-8 and path.utf-8, which some old clients read instead of name and path to display non-ASCII names. Changes the infohash" name:"legacy-utf8-name"`
 
-// ---------- Torrent structures (bencode) ----------
+	TorrentNameSuffix string `help:"Name the torrent <name>.SUFFIX.torrent, so that variants (per tracker, say) can share an output directory. The metalink's metaurl follows" name:"torrent-name-suffix" placeholder:"SUFFIX"`
 
-type Torrent struct {
-	Announce     string      `bencode:"announce"`
-	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
-	URLList      []string    `bencode:"url-list,omitempty"`
-	Info         TorrentInfo `bencode:"info"`
-}
+	RelativeMirrors bool `help:"Also give each file a URL relative to the metalink, e.g. d/sub/x.log, for publishing the metalink together with the files where the host isn't known yet. Relative URLs aren't valid RFC 5854 and only clients that resolve them against the metalink's location can use them" name:"relative-mirrors"`
 
-type TorrentInfo struct {
-	PieceLength int64             `bencode:"piece length"`
-	Pieces      string            `bencode:"pieces"`
-	Name        string            `bencode:"name"`
-	Length      int64             `bencode:"length,omitempty"`
-	Files       []TorrentFileInfo `bencode:"files,omitempty"`
-}
+	FlatMirror bool `help:"Mirrors hold every file of a directory by its base name in one folder: URLs use the file name only, while the metalink and torrent keep full paths. The mirrors are left out of the torrent url-list, which can't express that layout" name:"flat-mirror"`
 
-type TorrentFileInfo struct {
-	Length int64    `bencode:"length"`
-	Path   []string `bencode:"path"`
-}
+	MaxConnections int `help:"Hint that clients open at most this many connections per file, as an mkmetalink extension element (see README)" name:"max-connections" placeholder:"N"`
 
-var CLI struct {
-	Sign    string   `help:"If set, pass this GPG --local-user (key id) to sign" optional:"" aliases:"pgp,gpg"`
-	Tracker string   `help:"Tracker URL for generated torrent's announce (default privtracker)" default:"https://privtracker.com/metalink/announce"`
-	OutDir  string   `help:"Optional output directory for generated files. Default: input file's parent directory or input directory" short:"o" optional:""`
-	Mirrors []string `name:"mirrors" short:"m" help:"HTTPS mirrors (if directory: base URLs)"`
+	MirrorPrefix string `help:"Prepend this to the file name in mirror URLs (not the metalink name), for mirrors whose object keys differ from the file names" name:"mirror-prefix" placeholder:"STRING"`
+	MirrorSuffix string `help:"Append this to the file name in mirror URLs (not the metalink name), e.g. .bin for a CDN that stores file.iso as file.iso.bin. For directories the mirrors are left out of the torrent url-list, which can't express the rename" name:"mirror-suffix" placeholder:"STRING"`
 
-	Path string `arg:"" name:"path" help:"File or directory to package" type:"path"`
-}
+	AllowCollisions bool `help:"Only warn when files would share a mirror URL (see --flat-mirror) instead of failing" name:"allow-collisions"`
 
-type FileInfo struct {
-	RelPath string
-	Size    int64
-}
+	MatchPieceSize string `help:"Use the piece length of this torrent instead of the automatic piece size, so that a torrent of the same content made from a re-download can cross-seed with it" name:"match-piece-size" type:"existingfile" placeholder:"FILE"`
 
-type FileHashResult struct {
-	RelPath     string
-	Size        int64
-	FileSHA256  string   // hex encoded
-	PieceHashes []string // hex encoded SHA-256 piece hashes (per-file boundaries)
-	Err         error
-}
+	FromTorrent string `help:"Reuse the announce, tracker tiers and url-list of an existing torrent, except where --tracker, --tracker-tier or --mirrors are given" type:"existingfile" placeholder:"FILE"`
 
-type MultiHasher struct {
-	pieceSize int64
+	GPGHome    string `help:"GnuPG home directory to sign from, instead of the default ~/.gnupg" name:"gpg-home" type:"existingdir" placeholder:"DIR"`
+	GPGKeyring string `help:"Public keyring file to use instead of the default keyring when signing" name:"gpg-keyring" type:"existingfile" placeholder:"FILE"`
 
-	// SHA-1 for torrent (crosses file boundaries)
-	torrentPieceBuffer *bytes.Buffer
-	torrentPieceSHA1   hash.Hash
-	torrentPieces      *bytes.Buffer
+	SignTarget string `help:"Which artifacts --sign signs: the metalink (an embedded <signature>, or see --detached-signature), the torrent (a detached <name>.torrent.asc, since torrents have no place for one) or both" enum:"metalink,torrent,both" default:"metalink" name:"sign-target"`
 
-	// SHA-256 for current file
-	fileSHA256 hash.Hash
+	DetachedSignature bool `help:"Sign the metalink with a detached <name>.meta4.asc next to it instead of an embedded <signature>, leaving the .meta4 as written" name:"detached-signature"`
 
-	// SHA-256 for per-file pieces (resets at file boundaries)
-	filePieceSHA256      hash.Hash
-	filePieceBuffer      int64
-	currentFilePieceList []string
-	currentFileByteCount int64
-	currentFileRelPath   string
+	SignatureMediatype string `help:"Mediatype of the embedded signature, for verifiers that expect a particular value (default: that of the signing method, application/pgp-signature for GPG)" name:"signature-mediatype" placeholder:"TYPE"`
 
-	results []FileHashResult
-}
+	MediaType bool     `help:"Add each file's content type, guessed from its extension, as an mkmetalink <mediatype> extension element. The guesses come from the system's MIME tables, so they can differ between machines" name:"mediatype"`
+	MimeMap   []string `help:"Content type for an extension, overriding the guess (repeatable). Implies --mediatype" name:"mime-map" placeholder:".EXT=TYPE"`
 
-func NewMultiHasher(pieceSize int64) *MultiHasher {
-	return &MultiHasher{
-		pieceSize:          pieceSize,
-		torrentPieceBuffer: new(bytes.Buffer),
-		torrentPieceSHA1:   sha1.New(),
-		torrentPieces:      new(bytes.Buffer),
-		fileSHA256:         sha256.New(),
-		filePieceSHA256:    sha256.New(),
-	}
-}
+	TrackerTier []string `help:"Comma-separated trackers forming one BEP-12 announce tier (repeatable, in priority order). Replaces --tracker" placeholder:"URL,..." sep:"none"`
 
-func (mh *MultiHasher) StartFile(relPath string) {
-	mh.currentFileRelPath = relPath
-	mh.fileSHA256.Reset()
-	mh.filePieceSHA256.Reset()
-	mh.filePieceBuffer = 0
-	mh.currentFilePieceList = nil
-	mh.currentFileByteCount = 0
-}
+	FileVersion []string `help:"Set the metalink <version> of files, as VERSION for all files or VERSION:GLOB for matching files. First match wins" placeholder:"VERSION[:GLOB]"`
 
-// Write processes a chunk of data
-func (mh *MultiHasher) Write(data []byte) error {
-	// Update file-level SHA-256
-	mh.fileSHA256.Write(data)
-	mh.currentFileByteCount += int64(len(data))
+	PieceHash []string `help:"Per-file piece hash types to list in the metalink, each in its own <pieces>" enum:"sha-256,sha-1" default:"sha-256"`
 
-	offset := 0
-	for offset < len(data) {
-		// Process file-piece SHA-256 (resets at file boundaries)
-		spaceLeftFile := mh.pieceSize - mh.filePieceBuffer
-		toWriteFile := int64(len(data) - offset)
-		if toWriteFile > spaceLeftFile {
-			toWriteFile = spaceLeftFile
-		}
+	ExtraPieceSize []ByteSize `help:"Also list per-file SHA-256 piece hashes at this piece size (repeatable), each in its own <pieces>, for clients that verify coarsely first and then drill down. Computed in the same pass" name:"extra-piece-size" placeholder:"SIZE"`
 
-		chunk := data[offset : offset+int(toWriteFile)]
-		mh.filePieceSHA256.Write(chunk)
-		mh.filePieceBuffer += toWriteFile
+	PiecesInTorrentOnly bool `help:"Leave per-file piece hashes out of the metalink; the torrent still carries its SHA-1 pieces" name:"pieces-in-torrent-only"`
+	HTTPOnly            bool `help:"Write only the metalink, without a torrent or its metaurl, for mirrors that can't use BitTorrent" name:"http-only"`
+	ExternalPieces      bool `help:"Write per-file piece hashes to <name>.pieces and reference them from the metalink instead of listing them inline. Only mkmetalink reads the reference; other clients see no piece hashes" name:"external-pieces"`
+	Canonical           bool `help:"Write the metalink in a fixed canonical XML form (sorted attributes, two-space indentation, LF newlines) that doesn't depend on the Go version, so signatures stay reproducible"`
+	EmbedTorrent        bool `help:"Embed the torrent in the metalink as a base64 data: URI metaurl instead of referencing the .torrent file. Adds about 27 bytes per piece" name:"embed-torrent"`
 
-		// Check if file piece is complete
-		if mh.filePieceBuffer == mh.pieceSize {
-			h := mh.filePieceSHA256.Sum(nil)
-			mh.currentFilePieceList = append(mh.currentFilePieceList, hex.EncodeToString(h))
-			mh.filePieceSHA256.Reset()
-			mh.filePieceBuffer = 0
-		}
+	PerFileMetalinks bool `help:"Also write a metalink for each file of a directory to <name>.metalinks/<relpath>.meta4, for mirrors that publish one next to each download. They list the file under its base name, with its hashes and mirror URLs but no torrent. With --sign, each is signed" name:"per-file-metalinks"`
 
-		offset += int(toWriteFile)
-	}
+	RootHash bool `help:"Add a merkle root over the SHA-256 of every file to the metalink, as an mkmetalink <root-hash> extension element, and print it: one value that pins the whole package (see README for the construction)" name:"root-hash"`
 
-	// Process torrent pieces (crosses file boundaries)
-	offset = 0
-	for offset < len(data) {
-		spaceLeftTorrent := mh.pieceSize - int64(mh.torrentPieceBuffer.Len())
-		toWriteTorrent := int64(len(data) - offset)
-		if toWriteTorrent > spaceLeftTorrent {
-			toWriteTorrent = spaceLeftTorrent
-		}
+	PreserveMode bool `help:"Mark files with an execute bit as executable in the torrent (the BEP-47 \"x\" attribute), so that clients that support it restore the bit. The metalink has no way to express it" name:"preserve-mode"`
 
-		chunk := data[offset : offset+int(toWriteTorrent)]
-		mh.torrentPieceBuffer.Write(chunk)
-		mh.torrentPieceSHA1.Write(chunk)
-		offset += int(toWriteTorrent)
+	TorrentDebug bool `help:"Also write <name>.torrent.txt, a human-readable dump of the torrent as parsed back from disk (trackers, files, piece count, infohash)" name:"torrent-debug"`
 
-		// Check if torrent piece is complete
-		if mh.torrentPieceBuffer.Len() == int(mh.pieceSize) {
-			sum := mh.torrentPieceSHA1.Sum(nil)
-			mh.torrentPieces.Write(sum)
-			mh.torrentPieceBuffer.Reset()
-			mh.torrentPieceSHA1.Reset()
-		}
-	}
+	SplitSize ByteSize `help:"Split a directory into parts of at most this size, each with its own <name>.partN.meta4 and .torrent, for mirrors or trackers with size limits. Files are kept whole and assigned in package order (see --sort-files-by); a file larger than the limit gets a part of its own" placeholder:"SIZE"`
 
-	return nil
-}
+	IndexURL string `help:"With --split-size, the base URL where the part metalinks and torrents will be published, for the mirror URLs of <name>.index.meta4" name:"index-url" placeholder:"URL"`
 
-func (mh *MultiHasher) EndFile() FileHashResult {
-	// Finalize file-level SHA-256
-	fileSHA256Hex := hex.EncodeToString(mh.fileSHA256.Sum(nil))
+	After string `help:"Run this command after a successful run, e.g. to publish the artifacts. {meta}, {torrent}, {infohash}, {name} and {bundle} are replaced by the output paths, infohash and artifact name. Arguments are split at spaces, with quotes grouping words; use sh -c for anything more. A failing command's exit status becomes the tool's. With --split-size it runs once per part" placeholder:"CMD"`
 
-	// Finalize last partial file piece if any
-	if mh.filePieceBuffer > 0 {
-		h := mh.filePieceSHA256.Sum(nil)
-		mh.currentFilePieceList = append(mh.currentFilePieceList, hex.EncodeToString(h))
-	}
+	Bundle     string `help:"Also package the metalink, torrent and piece hashes into this zip file" type:"path" placeholder:"FILE.zip"`
+	BundleOnly bool   `help:"Remove the individual files after writing --bundle" name:"bundle-only"`
 
-	result := FileHashResult{
-		RelPath:     mh.currentFileRelPath,
-		Size:        mh.currentFileByteCount,
-		FileSHA256:  fileSHA256Hex,
-		PieceHashes: mh.currentFilePieceList,
-		Err:         nil,
-	}
+	WalkFlags `embed:""`
 
-	mh.results = append(mh.results, result)
-	return result
-}
+	MinPieceCount int `help:"Reduce the automatic piece size (down to 16 KiB) until there are at least this many pieces, for finer verification of small content" placeholder:"N"`
 
-func (mh *MultiHasher) Finalize() {
-	// Finalize last torrent piece if partial
-	if mh.torrentPieceBuffer.Len() > 0 {
-		sum := mh.torrentPieceSHA1.Sum(nil)
-		mh.torrentPieces.Write(sum)
-	}
+	PieceSize  ByteSize `help:"Override the automatic piece size (power of two, at least 16KiB)" optional:"" placeholder:"SIZE"`
+	ReadBuffer ByteSize `help:"Size of the read buffer" default:"${read_buffer}"`
+	SizeUnits  string   `help:"Units for human-readable sizes: iec (KiB, base 1024) or si (KB, base 1000)" enum:"iec,si" default:"iec"`
+
+	SparseAware bool `help:"Skip reading the holes of sparse files (such as VM images) and hash zeros for them instead, on Linux. The hashing still covers every byte, so this saves disk time only" name:"sparse-aware"`
+
+	ShowLargest  int  `help:"List this many of the largest files after hashing (0 to disable)" default:"5" placeholder:"N"`
+	ProgressJSON bool `help:"Report progress as one JSON object per file on stderr instead of text" name:"progress-json"`
+
+	ProgressThrottle time.Duration `help:"Report progress at most once per this interval instead of after every file, for trees of many small files. Skipped files and the last file are always reported" name:"progress-throttle" placeholder:"DURATION"`
+	ProgressInterval time.Duration `help:"Also report progress while reading a file, every this often, so that a huge file shows movement. Unless --progress-throttle is given, it is set to the same interval, so that progress is reported by time rather than by file" name:"progress-interval" placeholder:"DURATION"`
+
+	CPUProfile string `help:"Write a CPU profile of the run to this file, for go tool pprof" name:"cpuprofile" type:"path" placeholder:"FILE"`
+	Trace      string `help:"Write an execution trace of the run to this file, for go tool trace" type:"path" placeholder:"FILE"`
+	Timings    bool   `help:"Report the time spent in each phase, with hashing split into reading and hashing, to tell whether the disk or the CPU is the bottleneck before tuning --read-buffer"`
+
+	LowMemory bool `help:"Write each file's metalink entry as soon as it is hashed instead of keeping every piece hash in memory, for trees whose piece hashes don't fit in RAM. Can't be combined with --embed-torrent, --external-pieces, --canonical, --checkpoint, --verify-after-generate or --update-file" name:"low-memory"`
+
+	Strict bool `help:"Fail on the first RFC 5854 violation in the metalink (see README for the rules), or when the torrent has no tracker and no web seeds, e.g. as a release gate"`
+
+	VerifyAfterGenerate bool `help:"Read every file a second time and check it against the computed hashes before writing anything. Doubles the I/O" name:"verify-after-generate"`
+	VerifyPieceParallel int  `help:"With --verify-after-generate, check the per-file pieces with this many parallel readers instead of re-hashing in order, for storage that is faster with several reads in flight. Local files only" name:"verify-piece-parallel" placeholder:"N"`
+
+	RequireWebseeds bool `help:"Fail unless every file can be fetched from at least one HTTP(S)/FTP mirror" name:"require-webseeds"`
+	NoSelfCheck     bool `help:"Skip the internal consistency check of piece hashes after hashing" name:"no-self-check"`
+
+	KeepGoing  bool   `help:"Leave out files that can't be read instead of stopping and list them in <name>.errors.txt. The artifacts are still written, but the exit status is non-zero" name:"keep-going"`
+	Checkpoint string `help:"Save hashing progress to this file and resume from it if it exists" type:"path" optional:""`
+	KeepTemp   bool   `help:"Leave temporary files in place for debugging a failed run: partial .tmp outputs, the --checkpoint after success, and <name>.meta4.unsigned, a copy of the metalink from before --sign" name:"keep-temp"`
+	UpdateFile string `help:"Re-hash only this file (relative to the input directory) and update its entry in the existing metalink. The torrent is left as is and must be regenerated" placeholder:"RELPATH"`
+
+	ChecksumCache string `help:"Remember the hashes of each file in this JSON file, by absolute path, size and modification time, and reuse them on later runs. The torrent pieces span files, so any change means reading every file again, except with --http-only, where only the changed files are read" name:"checksum-cache" type:"path" placeholder:"FILE"`
+
+	URL         []string      `name:"url" help:"Hash remote HTTP(S) files instead of a local path (repeatable). The URLs become the mirrors" placeholder:"URL"`
+	Retries     int           `help:"Retries for failed HTTP requests, with exponential backoff" default:"3"`
+	HTTPTimeout time.Duration `help:"Timeout for connecting and receiving response headers" default:"30s" name:"http-timeout"`
+	HTTPHeader  []string      `help:"Send this header with every HTTP request, except after a redirect to another host (repeatable)" name:"http-header" placeholder:"'KEY: VALUE'" sep:"none"`
+
+	StdinTar bool     `help:"Read the files from a tar stream on stdin instead of a path, e.g. tar c DIR | mkmetalink --stdin-tar, hashing them in the tar's order without staging them on disk. The entries must be inside one directory, which names the artifacts" name:"stdin-tar"`
+	Total    ByteSize `help:"With --stdin-tar, the expected size of the files, for the automatic piece size and progress percentages. Without it, --piece-size must be given" placeholder:"SIZE"`
+
+	Map []string `help:"Package this file under this path instead of a path argument (repeatable), to publish a tree laid out differently from the disk. The paths must be inside one directory, which names the artifacts, or name a single file" placeholder:"SRC=PATH" sep:"none"`
+
+	Path string `arg:"" name:"path" help:"File or directory to package" type:"path" optional:""`
+
+	lfsOIDs map[string]string // by RelPath, for files read from Git LFS objects
+
+	matchedPieceSize string // the --match-piece-size torrent, once it set PieceSize
+
+	// With --stdin-tar, the files are hashed as they are listed
+	tarResults []metalink.FileHashResult
+	tarPieces  metalink.TorrentPieces
+
+	// With --split-size, each part is generated from its share of the tree
+	// under its own artifact name
+	part     *metalink.Tree
+	partName string
 }
 
-func (mh *MultiHasher) GetTorrentPieces() []byte {
-	return mh.torrentPieces.Bytes()
+// progressLine is written to stderr after each file with --progress-json
+type progressLine struct {
+	RelPath string  `json:"relpath"`
+	URL     string  `json:"url,omitempty"`
+	Bytes   int64   `json:"bytes"` // finished so far, across all files
+	Total   int64   `json:"total"`
+	Files   int     `json:"files"`           // finished so far
+	Count   int     `json:"count,omitempty"` // files in all, when known
+	Rate    int64   `json:"rate"`            // bytes per second
+	Percent float64 `json:"percent"`
+	Error   string  `json:"error,omitempty"` // the file was skipped with --keep-going
+
+	Partial bool `json:"partial,omitempty"` // relpath is still being read, with --progress-interval
 }
 
-func (mh *MultiHasher) GetResults() []FileHashResult {
-	return mh.results
+var CLI struct {
+	Generate GenerateCmd `cmd:"" default:"withargs" help:"Generate a metalink and torrent for a file or directory"`
+	Selftest SelftestCmd `cmd:"" help:"Generate artifacts for a synthetic tree and check that they parse back correctly"`
+	Compare  CompareCmd  `cmd:"" help:"Show the files added, removed, changed or renamed between two metalinks"`
+	List     ListCmd     `cmd:"" help:"Print the files that generate would package, with their sizes, without hashing them"`
 }
 
 func main() {
-	ctx := kong.Parse(&CLI)
-	_ = ctx
+	options := append([]kong.Option{
+		kong.Vars{
+			"read_buffer":     metalink.FormatBytes(metalink.CHUNK_SIZE, 1024),
+			"default_tracker": defaultTracker,
+		},
+	}, configOptions()...)
+	parser := kong.Must(&CLI, options...)
+	ctx, err := parser.Parse(os.Args[1:])
+	if err != nil {
+		parser.FatalIfErrorf(usageError(err))
+	}
+	err = ctx.Run()
+	// Pass on the exit status of a failed --after command, unless the error
+	// has one of its own, as a failed gpg does
+	var coded exitError
+	var exitErr *exec.ExitError
+	if !errors.As(err, &coded) && errors.As(err, &exitErr) {
+		fmt.Fprintf(os.Stderr, "%s: error: %v\n", ctx.Model.Name, err)
+		if exitErr.ExitCode() <= 0 {
+			// Killed by a signal
+			os.Exit(exitFailure)
+		}
+		os.Exit(exitErr.ExitCode())
+	}
+	ctx.FatalIfErrorf(err)
+}
+
+// checkFlags rejects invalid values and combinations of flags, before
+// anything is read
+func (c *GenerateCmd) checkFlags() error {
+	if c.ReadBuffer <= 0 {
+		return errors.New("read buffer must be positive")
+	}
+	if len(c.ExtraPieceSize) > 0 && c.PiecesInTorrentOnly {
+		return errors.New("extra-piece-size adds piece hashes to the metalink, which --pieces-in-torrent-only leaves out")
+	}
+	if c.ExternalPieces && c.PiecesInTorrentOnly {
+		return errors.New("external-pieces has nothing to write with --pieces-in-torrent-only")
+	}
+	if c.HTTPOnly && (c.PiecesInTorrentOnly || c.Merkle || c.EmbedTorrent || c.TorrentDebug) {
+		return errors.New("http-only writes no torrent, so it can't be combined with --pieces-in-torrent-only, --merkle, --embed-torrent or --torrent-debug")
+	}
+	if c.LowMemory && (c.EmbedTorrent || c.ExternalPieces || c.Canonical || c.Checkpoint != "" || c.VerifyAfterGenerate || c.UpdateFile != "") {
+		return errors.New("low-memory writes the metalink while hashing, so it can't be combined with --embed-torrent, --external-pieces, --canonical, --checkpoint, --verify-after-generate or --update-file")
+	}
+	if c.PerFileMetalinks && c.LowMemory {
+		return errors.New("per-file-metalinks needs the whole metalink in memory, so it can't be combined with --low-memory")
+	}
+	if (c.GPGHome != "" || c.GPGKeyring != "") && c.Sign == "" {
+		return errors.New("gpg-home and gpg-keyring need --sign")
+	}
+	if c.SignTarget != "metalink" {
+		if c.Sign == "" {
+			return errors.New("sign-target needs --sign")
+		}
+		if c.HTTPOnly {
+			return errors.New("sign-target torrent or both needs a torrent, which --http-only doesn't write")
+		}
+	}
+	if c.DetachedSignature && !c.signsMetalink() {
+		return errors.New("detached-signature needs --sign with a metalink --sign-target")
+	}
+	if c.SignatureMediatype != "" {
+		if c.DetachedSignature {
+			return errors.New("signature-mediatype is for the embedded signature, which --detached-signature doesn't write")
+		}
+		if !c.signsMetalink() {
+			return errors.New("signature-mediatype needs --sign with a metalink --sign-target")
+		}
+		if _, _, err := mime.ParseMediaType(c.SignatureMediatype); err != nil {
+			return fmt.Errorf("signature-mediatype: %w", err)
+		}
+	}
+	if c.MirrorPrefix != "" || c.MirrorSuffix != "" {
+		if len(c.Mirrors) == 0 {
+			return errors.New("mirror-prefix and mirror-suffix need --mirrors")
+		}
+		if strings.Contains(c.MirrorPrefix+c.MirrorSuffix, "/") {
+			return errors.New("mirror-prefix and mirror-suffix apply to the file name, so they can't contain /")
+		}
+	}
+	if c.VerifyPieceParallel != 0 && !c.VerifyAfterGenerate {
+		return errors.New("verify-piece-parallel needs --verify-after-generate")
+	}
+	if c.VerifyPieceParallel < 0 {
+		return errors.New("verify-piece-parallel must be positive")
+	}
+	if c.VerifyPieceParallel > 0 && len(c.URL) > 0 {
+		return errors.New("verify-piece-parallel reads local files at offsets, so it can't be combined with --url")
+	}
+	if strings.ContainsAny(c.TorrentNameSuffix, `/\`) {
+		return errors.New("torrent-name-suffix is part of a file name, so it can't contain a path separator")
+	}
+	if c.SplitSize > 0 && (c.UpdateFile != "" || c.Checkpoint != "" || c.Bundle != "") {
+		return errors.New("split-size writes several metalinks, so it can't be combined with --update-file, --checkpoint or --bundle")
+	}
+	if c.RelativeMirrors && (len(c.URL) > 0 || c.StdinTar || c.Strict) {
+		return errors.New("relative-mirrors needs local files and relative URLs fail --strict, so it can't be combined with --url, --stdin-tar or --strict")
+	}
+	if c.ChecksumCache != "" && (len(c.URL) > 0 || c.StdinTar || c.LowMemory || c.Checkpoint != "") {
+		return errors.New("checksum-cache keeps the hashes of local files, so it can't be combined with --url, --stdin-tar, --low-memory or --checkpoint")
+	}
+	if len(c.Map) > 0 && (c.Path != "" || len(c.URL) > 0 || c.StdinTar || c.UpdateFile != "" || c.RelativeMirrors) {
+		return errors.New("map lists the files instead of a path, so it can't be combined with a path, --url, --stdin-tar, --update-file or --relative-mirrors")
+	}
+	if c.IndexURL != "" && c.SplitSize == 0 {
+		return errors.New("index-url needs --split-size")
+	}
+	if c.BundleOnly && c.Bundle == "" {
+		return errors.New("bundle-only needs --bundle")
+	}
+	if c.After != "" {
+		if err := c.checkAfter(); err != nil {
+			return err
+		}
+	}
+	if c.MatchPieceSize != "" && (c.PieceSize > 0 || c.MinPieceCount > 0) {
+		return errors.New("match-piece-size sets the piece size, so it can't be combined with --piece-size or --min-piece-count")
+	}
+	if c.Total != 0 && !c.StdinTar {
+		return errors.New("total needs --stdin-tar")
+	}
+	if c.StdinTar {
+		if c.Path != "" || len(c.URL) > 0 {
+			return errors.New("stdin-tar reads the files from stdin, so it can't be combined with a path or --url")
+		}
+		if c.PieceSize == 0 && c.Total == 0 && c.MatchPieceSize == "" {
+			return errors.New("stdin-tar can't size pieces before reading the whole tar; give --piece-size or --total")
+		}
+		if c.UpdateFile != "" || c.Checkpoint != "" || c.SplitSize > 0 || c.LowMemory || c.VerifyAfterGenerate || c.MinPieceCount > 0 || c.ResolveLFS || c.SanitizeNames {
+			return errors.New("stdin-tar reads the files once, as they arrive, so it can't be combined with --update-file, --checkpoint, --split-size, --low-memory, --verify-after-generate, --min-piece-count, --resolve-lfs or --sanitize-names")
+		}
+		if c.SortFilesBy != "name" {
+			return errors.New("sort-files-by doesn't apply to --stdin-tar, whose files keep the tar's order")
+		}
+	}
+	if c.MinPieceCount > 0 && c.PieceSize > 0 {
+		return errors.New("min-piece-count adjusts the automatic piece size, so it can't be combined with --piece-size")
+	}
+	if c.ProgressInterval < 0 {
+		return errors.New("progress-interval must be positive")
+	}
+	if c.MaxConnections < 0 {
+		return errors.New("max-connections must be positive")
+	}
+	return nil
+}
 
-	info, err := os.Stat(CLI.Path)
+func (c *GenerateCmd) Run() error {
+	stopProfiling, err := c.startProfiling()
+	defer stopProfiling()
 	if err != nil {
-		log.Fatalf("stat %s: %v", CLI.Path, err)
+		return err
 	}
+	timings := newPhaseTimings()
 
-	var files []FileInfo
-	var total int64
+	sizeBase := 1024.0
+	if c.SizeUnits == "si" {
+		sizeBase = 1000
+	}
 
-	if info.IsDir() {
-		err = filepath.Walk(CLI.Path, func(path string, fi os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !fi.Mode().IsRegular() {
-				return nil
-			}
-			rel, err := filepath.Rel(CLI.Path, path)
-			if err != nil {
-				return err
+	opts := metalink.Options{
+		ReadBuffer:  int64(c.ReadBuffer),
+		Checkpoint:  c.Checkpoint,
+		NoSelfCheck: c.NoSelfCheck,
+		KeepGoing:   c.KeepGoing,
+		SHA1Pieces:  slices.Contains(c.PieceHash, "sha-1"),
+		SparseAware: c.SparseAware,
+		Logf:        log.Printf,
+	}
+	if err := c.checkFlags(); err != nil {
+		return usageError(err)
+	}
+	for _, size := range c.ExtraPieceSize {
+		if slices.Contains(opts.ExtraPieceSizes, int64(size)) {
+			return usageError(fmt.Errorf("extra-piece-size %d is given twice", size))
+		}
+		opts.ExtraPieceSizes = append(opts.ExtraPieceSizes, int64(size))
+	}
+	if c.Timings {
+		opts.Timings = &timings.hashing
+	}
+	if c.Sign != "" {
+		// Fail before hashing rather than after
+		if err := metalink.CheckGPG(); err != nil {
+			return exitError{err, exitSign}
+		}
+		if err := metalink.CheckGPGKey(c.Sign, metalink.GPGOptions{Homedir: c.GPGHome, Keyring: c.GPGKeyring}); err != nil {
+			return exitError{err, exitSign}
+		}
+	}
+	if c.MatchPieceSize != "" {
+		old, err := metalink.ReadTorrentFile(c.MatchPieceSize)
+		if err != nil {
+			return fmt.Errorf("match-piece-size: %w", err)
+		}
+		c.PieceSize = ByteSize(old.Info.PieceLength)
+		c.matchedPieceSize, c.MatchPieceSize = c.MatchPieceSize, ""
+	}
+	// Output carries no timestamps unless a reproducible build asks for one
+	var sourceDate time.Time
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("SOURCE_DATE_EPOCH: %w", err)
+		}
+		sourceDate = time.Unix(secs, 0)
+	}
+	var trackerTiers [][]string
+	for i, tier := range c.TrackerTier {
+		var trackers []string
+		for _, tr := range strings.Split(tier, ",") {
+			if tr = strings.TrimSpace(tr); tr != "" {
+				trackers = append(trackers, tr)
 			}
-			files = append(files, FileInfo{RelPath: rel, Size: fi.Size()})
-			total += fi.Size()
-			return nil
-		})
+		}
+		if len(trackers) == 0 {
+			return usageError(fmt.Errorf("tracker-tier %d is empty", i+1))
+		}
+		trackerTiers = append(trackerTiers, trackers)
+	}
+	mimeMap := make(map[string]string)
+	for _, m := range c.MimeMap {
+		ext, typ, ok := strings.Cut(m, "=")
+		if !ok || !strings.HasPrefix(ext, ".") {
+			return usageError(fmt.Errorf("mime-map %q is not .EXT=TYPE", m))
+		}
+		if _, _, err := mime.ParseMediaType(typ); err != nil {
+			return usageError(fmt.Errorf("mime-map %s: %w", m, err))
+		}
+		mimeMap[strings.ToLower(ext)] = typ
+	}
+	var oldWebseeds []string
+	if c.FromTorrent != "" {
+		old, err := metalink.ReadTorrentFile(c.FromTorrent)
 		if err != nil {
-			log.Fatalf("walk: %v", err)
+			return fmt.Errorf("from-torrent: %w", err)
+		}
+		if c.Tracker == defaultTracker && len(trackerTiers) == 0 {
+			c.Tracker = old.Announce
+			trackerTiers = old.AnnounceList
+		}
+		if len(c.Mirrors) == 0 {
+			oldWebseeds = old.URLList
 		}
-	} else {
-		files = []FileInfo{{RelPath: filepath.Base(CLI.Path), Size: info.Size()}}
-		total = info.Size()
 	}
-
-	if len(files) == 0 {
-		log.Fatalf("no files found under %s", CLI.Path)
+	mirrors, mirrorConns, err := parseMirrors(c.Mirrors)
+	if err != nil {
+		return usageError(err)
+	}
+	header, err := metalink.ParseHTTPHeaders(c.HTTPHeader)
+	if err != nil {
+		return usageError(fmt.Errorf("http-header: %w", err))
+	}
+	opts.HTTPClient = metalink.NewHTTPClient(c.Retries, c.HTTPTimeout, header)
+	var resumedBytes int64
+	opts.Resume = func(files int, bytes int64) {
+		resumedBytes = bytes
+		fmt.Printf("Resuming after %d files (%s)\n", files, metalink.FormatBytes(bytes, sizeBase))
+	}
+	progressJSON := json.NewEncoder(os.Stderr)
+	var lastProgress time.Time
+	throttle := c.ProgressThrottle
+	if throttle == 0 {
+		throttle = c.ProgressInterval
+	}
+	opts.ProgressInterval = c.ProgressInterval
+	opts.Progress = func(p metalink.Progress) {
+		if p.Err == nil && p.Files != p.Count && time.Since(lastProgress) < throttle {
+			return
+		}
+		lastProgress = time.Now()
+		rate := float64(p.Bytes-p.Resumed) / p.Elapsed.Seconds()
+		total := p.Total
+		if c.StdinTar {
+			// Known only from --total
+			total = int64(c.Total)
+		}
+		if c.ProgressJSON {
+			line := progressLine{
+				RelPath: p.File.RelPath,
+				URL:     p.File.URL,
+				Bytes:   p.Bytes,
+				Total:   total,
+				Files:   p.Files,
+				Count:   p.Count,
+				Percent: 100,
+				Partial: p.Partial,
+			}
+			if p.Err != nil {
+				line.Error = p.Err.Error()
+			}
+			if p.Elapsed > 0 {
+				line.Rate = int64(rate)
+			}
+			switch {
+			case total > 0:
+				line.Percent = float64(p.Bytes) / float64(total) * 100
+			case c.StdinTar:
+				line.Percent = 0
+			}
+			if err := progressJSON.Encode(line); err != nil {
+				log.Printf("progress-json: %v", err)
+			}
+			return
+		}
+		if p.Err != nil {
+			fmt.Printf("  skipped %s: %v\n", p.File.RelPath, p.Err)
+			return
+		}
+		files := fmt.Sprintf("[%d/%d]", p.Files, p.Count)
+		if p.Count == 0 {
+			files = fmt.Sprintf("[%d]", p.Files)
+		}
+		if p.File.URL != "" {
+			fmt.Printf("  %s %s/s %s  %s\n", metalink.FormatBytes(p.Bytes, sizeBase), metalink.FormatBytes(int64(rate), sizeBase), files, p.File.URL)
+			return
+		}
+		if total <= 0 {
+			fmt.Printf("  %s %s/s %s  %s\n", metalink.FormatBytes(p.Bytes, sizeBase), metalink.FormatBytes(int64(rate), sizeBase), files, p.File.RelPath)
+			return
+		}
+		progress := float64(p.Bytes) / float64(total) * 100
+		fmt.Printf("  %.1f%% %s/s %s  %s\n", progress, metalink.FormatBytes(int64(rate), sizeBase), files, p.File.RelPath)
 	}
-
-	pieceSize := calculatePieceSize(total)
-	fmt.Printf("Total size: %s, piece size: %s, %d files\n", formatBytes(total), formatBytes(pieceSize), len(files))
-
-	// Single-pass hashing: both torrent (SHA-1) and per-file (SHA-256)
-	mh := NewMultiHasher(pieceSize)
 
 	startTime := time.Now()
-	var totalBytesProcessed int64
-
-	// Reuse buffer across all files
-	buf := make([]byte, CHUNK_SIZE)
-
-	for _, fi := range files {
-		full := CLI.Path
-		if info.IsDir() {
-			full = filepath.Join(CLI.Path, fi.RelPath)
+	tree, err := c.walkTree(&opts)
+	if err != nil {
+		return err
+	}
+	timings.mark("walk")
+	if tree.IsDir && c.part == nil && !c.StdinTar && len(c.Map) == 0 {
+		for _, dir := range []string{c.outDir(), c.metaOutDir(), c.torrentOutDir()} {
+			if !isInside(dir, tree.Root) {
+				continue
+			}
+			if c.IncludeArtifacts {
+				log.Printf("warning: writing artifacts inside %s with --include-artifacts; the next run will package them", tree.Root)
+			} else {
+				log.Printf("note: writing artifacts inside %s; later runs skip them, but mirrors of the directory will carry them", tree.Root)
+			}
+			break
 		}
+	}
 
-		mh.StartFile(fi.RelPath)
-
-		f, err := os.Open(full)
-		if err != nil {
-			log.Fatalf("open %s: %v", full, err)
+	if err := metalink.ValidateFileVersions(c.FileVersion); err != nil {
+		return err
+	}
+	if c.FlatMirror {
+		// One file's URL would shadow the others', so stop before hashing
+		collisions := metalink.FlatCollisions(tree)
+		for _, group := range collisions {
+			log.Printf("%s share one flat mirror URL", strings.Join(group, ", "))
+		}
+		if len(collisions) > 0 && !c.AllowCollisions {
+			return fmt.Errorf("%d flat mirror URL collisions; rename the files or pass --allow-collisions", len(collisions))
 		}
+	}
+	if c.UpdateFile != "" {
+		return c.updateFile(tree, opts)
+	}
+	if c.SplitSize > 0 && c.part == nil {
+		return c.runSplit(tree)
+	}
+	if c.RequireWebseeds {
+		if err := metalink.CheckWebseeds(tree, mirrors, !c.NoWrap); err != nil {
+			return fmt.Errorf("require-webseeds: %w", err)
+		}
+	}
 
-		var fileBytes int64
-		for {
-			n, err := f.Read(buf)
-			if n > 0 {
-				if err := mh.Write(buf[:n]); err != nil {
-					f.Close()
-					log.Fatalf("processing %s: %v", full, err)
-				}
-				totalBytesProcessed += int64(n)
-				fileBytes += int64(n)
+	pieceSize := metalink.CalculatePieceSize(tree.Total)
+	if c.StdinTar {
+		pieceSize = c.tarPieces.PieceLength
+	}
+	if c.PieceSize == 0 {
+		for _, fi := range tree.Files {
+			if fi.Size < 0 {
+				return fmt.Errorf("%s did not report its size; set --piece-size", fi.URL)
 			}
-			if err == io.EOF {
-				break
+		}
+	}
+	if c.PieceSize > 0 {
+		pieceSize = int64(c.PieceSize)
+		if pieceSize < 16*1024 || pieceSize&(pieceSize-1) != 0 {
+			return fmt.Errorf("piece size %s must be a power of two of at least 16 KiB", metalink.FormatBytes(pieceSize, sizeBase))
+		}
+	} else if c.MinPieceCount > 0 {
+		pieceSize = metalink.FinerPieceSize(tree.Total, pieceSize, c.MinPieceCount)
+		if (tree.Total+pieceSize-1)/pieceSize < int64(c.MinPieceCount) {
+			log.Printf("warning: only %d pieces at the smallest piece size", (tree.Total+pieceSize-1)/pieceSize)
+		}
+	}
+	if c.matchedPieceSize != "" {
+		if auto := metalink.CalculatePieceSize(tree.Total); auto != pieceSize {
+			log.Printf("warning: using the %s pieces of %s, where this content would get %s pieces", metalink.FormatBytes(pieceSize, sizeBase), c.matchedPieceSize, metalink.FormatBytes(auto, sizeBase))
+		}
+	}
+	opts.PieceSize = pieceSize
+	if slices.Contains(opts.ExtraPieceSizes, pieceSize) {
+		return fmt.Errorf("extra-piece-size %s is the piece size already", metalink.FormatBytes(pieceSize, sizeBase))
+	}
+	fmt.Printf("Total size: %s, piece size: %s, %d files\n", metalink.FormatBytes(tree.Total, sizeBase), metalink.FormatBytes(pieceSize, sizeBase), len(tree.Files))
+	if err := c.checkDiskFree(tree, pieceSize, sizeBase); err != nil {
+		return err
+	}
+
+	outDir, metaDir, torrentDir := c.outDir(), c.metaOutDir(), c.torrentOutDir()
+	artifactName := tree.Name
+	if c.partName != "" {
+		artifactName = c.partName
+	}
+	metaPath := filepath.Join(metaDir, artifactName+".meta4")
+	torPath := filepath.Join(torrentDir, artifactName+c.torrentExt())
+
+	// The metaurl is relative to the metalink, wherever the torrent goes
+	absMetaDir, err := filepath.Abs(metaDir)
+	if err != nil {
+		return err
+	}
+	absTorPath, err := filepath.Abs(torPath)
+	if err != nil {
+		return err
+	}
+	torrentRef, err := filepath.Rel(absMetaDir, absTorPath)
+	if err != nil {
+		return fmt.Errorf("torrent-out-dir: %w", err)
+	}
+	metaOpts := metalink.MetalinkOptions{
+		Mirrors:      mirrors,
+		NoWrap:       c.NoWrap,
+		FileVersions: c.FileVersion,
+		TorrentName:  filepath.ToSlash(torrentRef),
+		NoPieces:     c.PiecesInTorrentOnly,
+		FlatMirror:   c.FlatMirror,
+		MirrorPrefix: c.MirrorPrefix,
+		MirrorSuffix: c.MirrorSuffix,
+		Strict:       c.Strict,
+		Published:    sourceDate,
+		MediaTypes:   c.MediaType || len(mimeMap) > 0,
+		MimeMap:      mimeMap,
+
+		MaxConnections:       c.MaxConnections,
+		MirrorMaxConnections: mirrorConns,
+
+		PieceHashTypes: c.PieceHash,
+		RootHash:       c.RootHash,
+
+		Logf: log.Printf,
+	}
+	if c.HTTPOnly {
+		metaOpts.TorrentName = ""
+	}
+	if c.RelativeMirrors {
+		metaOpts.RelativeTo = metaDir
+		// The references only hold if the layout is kept when publishing
+		for _, target := range []string{tree.Root, absTorPath} {
+			if target == absTorPath && (c.HTTPOnly || c.EmbedTorrent) {
+				continue
 			}
+			absTarget, err := filepath.Abs(target)
 			if err != nil {
-				f.Close()
-				log.Fatalf("reading %s: %v", full, err)
+				return err
+			}
+			if !isInside(absTarget, absMetaDir) {
+				log.Printf("warning: %s is outside %s, so the metalink's relative URLs only work if it is published at the same relative location", target, metaDir)
 			}
 		}
-		f.Close()
-
-		mh.EndFile()
+	}
 
-		// Calculate and display progress
-		elapsed := time.Since(startTime).Seconds()
-		rate := float64(totalBytesProcessed) / elapsed / (1024 * 1024)
-		progress := float64(totalBytesProcessed) / float64(total) * 100
-		fmt.Printf("  %.1f%% %.1f MiB/s   %s\n", progress, rate, fi.RelPath)
+	var metaStream *metalink.MetalinkWriter
+	var metaTmp *os.File
+	if c.LowMemory {
+		if err := c.mkdirOut(metaDir); err != nil {
+			return fmt.Errorf("creating outdir: %w", err)
+		}
+		metaTmp, err = os.Create(metaPath + ".tmp")
+		if err != nil {
+			return fmt.Errorf("write meta4: %w", err)
+		}
+		defer c.removeTemp(metaTmp.Name())
+		defer metaTmp.Close()
+		metaStream, err = metalink.NewMetalinkWriter(metaTmp, tree, pieceSize, metaOpts)
+		if err != nil {
+			return fmt.Errorf("write meta4: %w", err)
+		}
+		opts.OnResult = metaStream.WriteFile
 	}
 
-	mh.Finalize()
+	// Single-pass hashing: both torrent (SHA-1) and per-file (SHA-256)
+	results, pieces := c.tarResults, c.tarPieces
+	if !c.StdinTar {
+		startTime = time.Now()
+		var cachedBytes int64
+		results, pieces, cachedBytes, err = c.hashTree(tree, opts)
+		if err != nil {
+			return err
+		}
+		resumedBytes += cachedBytes
+	}
+	if c.LowMemory {
+		if err := metaStream.Close(); err != nil {
+			return fmt.Errorf("write meta4: %w", err)
+		}
+		if err := metaTmp.Close(); err != nil {
+			return fmt.Errorf("write meta4: %w", err)
+		}
+		if err := os.Rename(metaTmp.Name(), metaPath); err != nil {
+			return fmt.Errorf("write meta4: %w", err)
+		}
+	}
+	timings.mark("hashing")
+	results, failed := metalink.DropFailed(&tree, results)
+	if len(tree.Files) == 0 {
+		return fmt.Errorf("none of the %d files could be read", len(failed))
+	}
+	for _, r := range results {
+		if oid, ok := c.lfsOIDs[r.RelPath]; ok && r.FileSHA256 != oid {
+			return fmt.Errorf("resolve-lfs: %s: LFS object %s hashes to %s", r.RelPath, oid, r.FileSHA256)
+		}
+	}
 
 	// Final statistics
 	elapsed := time.Since(startTime).Seconds()
-	avgRate := float64(totalBytesProcessed) / elapsed / (1024 * 1024)
-	fmt.Printf("\nCompleted in %.2fs (avg %.2f MiB/s)\n", elapsed, avgRate)
-
-	results := mh.GetResults()
-	resultMap := make(map[string]FileHashResult)
+	var hashed int64
 	for _, r := range results {
-		resultMap[r.RelPath] = r
+		hashed += r.Size
+	}
+	avgRate := float64(hashed-resumedBytes) / elapsed
+	fmt.Printf("\nCompleted in %.2fs (avg %s/s)\n", elapsed, metalink.FormatBytes(int64(avgRate), sizeBase))
+
+	if tree.IsDir && c.ShowLargest > 0 {
+		largest := slices.Clone(results)
+		slices.SortStableFunc(largest, func(a, b metalink.FileHashResult) int {
+			return cmp.Compare(b.Size, a.Size)
+		})
+		largest = largest[:min(c.ShowLargest, len(largest))]
+		fmt.Printf("\nLargest files:\n")
+		for _, r := range largest {
+			fmt.Printf("  %10s  %s\n", metalink.FormatBytes(r.Size, sizeBase), r.RelPath)
+		}
 	}
 
-	// Build MetaLink v4
-	meta := Metalink{
-		XMLNs:   "urn:ietf:params:xml:ns:metalink",
-		Version: "4.0",
+	if tree.IsDir && !c.HTTPOnly {
+		// Pieces shared by many files make partial downloads inefficient
+		avg, most := metalink.PieceSpans(tree.Files, pieceSize)
+		fmt.Printf("\nFiles per piece: %.1f on average, at most %d\n", avg, most)
+		if avg > maxFilesPerPiece {
+			log.Printf("warning: pieces span %.1f files on average; a smaller --piece-size (or --min-piece-count) would let clients fetch files more independently", avg)
+		}
 	}
 
-	baseName := filepath.Base(CLI.Path)
-	torrentName := baseName + ".torrent"
-	meta.Metaurls = []MetaURL{
-		{Priority: 1, MediaType: "application/x-bittorrent", Value: torrentName},
+	if c.VerifyAfterGenerate {
+		fmt.Printf("\nVerifying...\n")
+		if c.VerifyPieceParallel > 0 {
+			err = metalink.VerifyParallel(tree, results, pieceSize, c.VerifyPieceParallel, func(err error) {
+				log.Printf("verify: %v", err)
+			})
+		} else {
+			err = metalink.Verify(tree, results, pieces, opts)
+		}
+		if err != nil {
+			return exitError{fmt.Errorf("verify-after-generate: %w", err), exitVerify}
+		}
+		fmt.Printf("Verified %d files\n", len(results))
+		timings.mark("verify")
 	}
 
-	for _, fi := range files {
-		r := resultMap[fi.RelPath]
+	var tor metalink.Torrent
+	if !c.HTTPOnly {
+		torOpts := metalink.TorrentOptions{
+			Tracker: c.Tracker,
+			Mirrors: mirrors,
+			NoWrap:  c.NoWrap,
+			Merkle:  c.Merkle,
+
+			FlatMirror:   c.FlatMirror,
+			MirrorPrefix: c.MirrorPrefix,
+			MirrorSuffix: c.MirrorSuffix,
+			TrackerTiers: trackerTiers,
+			CreationDate: sourceDate,
+
+			LegacyUTF8Name: c.LegacyUTF8Name,
 
-		metaPieceHashes := make([]MetaPieceHash, len(r.PieceHashes))
-		for i, h := range r.PieceHashes {
-			metaPieceHashes[i] = MetaPieceHash{
-				Type:  "sha-256",
-				Value: h,
+			Logf: log.Printf,
+		}
+		if len(c.URL) > 0 {
+			torOpts.WebSeeds = metalink.RemoteWebseeds(tree)
+		}
+		torOpts.WebSeeds = append(torOpts.WebSeeds, oldWebseeds...)
+		tor, err = metalink.BuildTorrent(tree, pieces, torOpts)
+		if err != nil {
+			return err
+		}
+		if c.RequireWebseeds && len(tor.URLList) == 0 {
+			return errors.New("require-webseeds: torrent has no usable url-list entries")
+		}
+		// Torrents aren't marked private, so DHT is the only way left
+		if tor.Announce == "" && len(tor.AnnounceList) == 0 && len(tor.URLList) == 0 {
+			const msg = "torrent has no tracker and no web seeds, so peers can only be found through DHT"
+			if c.Strict {
+				return errors.New("strict: " + msg)
 			}
+			log.Printf("warning: %s", msg)
+		}
+		timings.mark("build torrent")
+	}
+
+	if c.EmbedTorrent {
+		metaOpts.TorrentData, err = metalink.MarshalTorrent(tor)
+		if err != nil {
+			return fmt.Errorf("embed torrent: %w", err)
+		}
+	}
+	var meta metalink.Metalink
+	if !c.LowMemory {
+		meta, err = metalink.BuildMetalink(tree, results, pieceSize, metaOpts)
+		if err != nil {
+			return err
+		}
+		timings.mark("build metalink")
+	}
+
+	for _, dir := range []string{outDir, metaDir, torrentDir} {
+		if err := c.mkdirOut(dir); err != nil {
+			return fmt.Errorf("creating outdir: %w", err)
+		}
+	}
+
+	var generated, bundled []string
+	if c.PerFileMetalinks {
+		if !tree.IsDir {
+			return errors.New("per-file-metalinks needs a directory; the metalink of a single file is per-file already")
+		}
+		dir := c.perFileDir(artifactName)
+		n, err := c.writePerFileMetalinks(dir, tree, meta)
+		if err != nil {
+			return fmt.Errorf("per-file-metalinks: %w", err)
+		}
+		fmt.Printf("\nWrote %d per-file metalinks\n", n)
+		generated = append(generated, dir)
+		timings.mark("per-file metalinks")
+	}
+	if c.ExternalPieces {
+		piecesName := artifactName + ".pieces"
+		data, err := metalink.ExternalizePieces(&meta, piecesName)
+		if err != nil {
+			return err
 		}
+		piecesPath := filepath.Join(metaDir, piecesName)
+		if err := c.writeOut(piecesPath, data); err != nil {
+			return fmt.Errorf("write pieces: %w", err)
+		}
+		generated = append(generated, piecesPath)
+		bundled = append(bundled, piecesPath)
+	}
 
-		relPath := filepath.ToSlash(fi.RelPath)
-		if info.IsDir() {
-			relPath = baseName + "/" + filepath.ToSlash(fi.RelPath)
+	if !c.LowMemory {
+		if err := c.writeMeta(metaPath, meta); err != nil {
+			return fmt.Errorf("write meta4: %w", err)
 		}
+		timings.mark("write metalink")
+	}
+	generated = append(generated, metaPath)
+	bundled = append(bundled, metaPath)
 
-		var urls []MetalinkURL
-		for i, m := range CLI.Mirrors {
-			u := strings.TrimRight(m, "/") + "/" + relPath
-			if !info.IsDir() && strings.HasSuffix(m, fi.RelPath) {
-				u = m
+	if !c.HTTPOnly {
+		if err := metalink.WriteTorrentFile(torPath, tor); err != nil {
+			return fmt.Errorf("write torrent: %w", err)
+		}
+		generated = append(generated, torPath)
+		bundled = append(bundled, torPath)
+
+		if c.TorrentDebug {
+			dumpPath := torPath + ".txt"
+			if err := metalink.WriteTorrentDump(dumpPath, torPath); err != nil {
+				return fmt.Errorf("write torrent dump: %w", err)
 			}
-			urls = append(urls, MetalinkURL{
-				Priority: i + 1,
-				Value:    u,
-			})
+			generated = append(generated, dumpPath)
 		}
+		timings.mark("write torrent")
+	}
 
-		mf := MetalinkFile{
-			Name: relPath,
-			Size: r.Size,
-			Hash: MetaHash{
-				Type:  "sha-256",
-				Value: r.FileSHA256,
-			},
-			Pieces: MetaPieces{
-				Type:   "sha-256",
-				Length: pieceSize,
-				Hashes: metaPieceHashes,
-			},
-			URLs: urls,
-		}
-		meta.Files = append(meta.Files, mf)
-	}
-
-	tor := Torrent{
-		Announce: CLI.Tracker,
-		Info: TorrentInfo{
-			PieceLength: pieceSize,
-			Pieces:      string(mh.GetTorrentPieces()),
-			Name:        baseName,
-		},
+	// A previous run's list would be misleading once the files are readable
+	errorsPath := filepath.Join(outDir, artifactName+".errors.txt")
+	if len(failed) > 0 {
+		if err := metalink.WriteErrorsFile(errorsPath, failed); err != nil {
+			return fmt.Errorf("write errors list: %w", err)
+		}
+		generated = append(generated, errorsPath)
+	} else if err := os.Remove(errorsPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("remove stale errors list: %v", err)
 	}
 
-	// Add web seeds (mirrors) to torrent
-	if len(CLI.Mirrors) > 0 {
-		if info.IsDir() {
-			// For multi-file torrents, mirrors should be base URLs
-			// the "url-list" must be a root folder where a client could add the "name" and "path/file"
-			tor.URLList = make([]string, len(CLI.Mirrors))
-			for i, m := range CLI.Mirrors {
-				tor.URLList[i] = strings.TrimRight(m, "/") + "/"
+	if c.signsMetalink() {
+		if c.KeepTemp && !c.DetachedSignature {
+			if err := copyFile(metaPath, metaPath+".unsigned"); err != nil {
+				return fmt.Errorf("keep-temp: %w", err)
 			}
-		} else {
-			// For single-file torrents, mirrors should be full URLs to the file
-			tor.URLList = make([]string, len(CLI.Mirrors))
-			for i, m := range CLI.Mirrors {
-				if strings.HasSuffix(m, baseName) {
-					tor.URLList[i] = m
-				} else {
-					tor.URLList[i] = strings.TrimRight(m, "/") + "/" + baseName
+		}
+		if err := c.sign(metaPath, &meta); err != nil {
+			return err
+		}
+		if c.DetachedSignature {
+			generated = append(generated, metaPath+".asc")
+			bundled = append(bundled, metaPath+".asc")
+		}
+	}
+	if c.signsTorrent() {
+		sigPath, err := c.signDetached(torPath)
+		if err != nil {
+			return err
+		}
+		generated = append(generated, sigPath)
+		bundled = append(bundled, sigPath)
+	}
+	if c.Sign != "" {
+		timings.mark("sign")
+	}
+
+	if c.Checkpoint != "" && !c.KeepTemp {
+		if err := os.Remove(c.Checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("remove checkpoint: %v", err)
+		}
+	}
+
+	if c.Bundle != "" {
+		if err := writeBundle(c.Bundle, bundled, sourceDate, c.KeepTemp); err != nil {
+			return fmt.Errorf("bundle: %w", err)
+		}
+		if c.BundleOnly {
+			for _, p := range bundled {
+				if err := os.Remove(p); err != nil {
+					return fmt.Errorf("bundle-only: %w", err)
 				}
 			}
+			generated = slices.DeleteFunc(generated, func(p string) bool { return slices.Contains(bundled, p) })
 		}
+		generated = append(generated, c.Bundle)
+		timings.mark("bundle")
 	}
 
-	if info.IsDir() {
-		var tFiles []TorrentFileInfo
-		for _, fi := range files {
-			tFiles = append(tFiles, TorrentFileInfo{
-				Length: fi.Size,
-				Path:   strings.Split(fi.RelPath, string(os.PathSeparator)),
-			})
+	for _, p := range generated {
+		if err := c.chmodOut(p); err != nil {
+			return err
 		}
-		tor.Info.Files = tFiles
-	} else {
-		tor.Info.Length = files[0].Size
 	}
+	fmt.Printf("\nGenerated:\n%s\n", strings.Join(generated, "\n"))
 
-	outDir := CLI.OutDir
-	if outDir == "" {
-		outDir = filepath.Dir(CLI.Path)
-		if outDir == "" {
-			outDir = "."
+	if c.RootHash {
+		var root string
+		if c.LowMemory {
+			root = metaStream.RootHash()
+		} else {
+			root = meta.RootHash.Value
 		}
+		fmt.Printf("\nRoot hash: %s\n", root)
 	}
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
-		log.Fatalf("creating outdir: %v", err)
+
+	var infohash string
+	if !c.HTTPOnly {
+		ih, err := metalink.InfoHash(tor.Info)
+		if err != nil {
+			return fmt.Errorf("infohash: %w", err)
+		}
+		infohash = fmt.Sprintf("%x", ih)
 	}
 
-	torPath := filepath.Join(outDir, torrentName)
-	if err := writeTorrentFile(torPath, tor); err != nil {
-		log.Fatalf("write torrent: %v", err)
+	if c.Timings {
+		timings.mark("other")
+		timings.print()
 	}
 
-	metaPath := filepath.Join(outDir, baseName+".meta4")
-	if err := writeMetaFile(metaPath, meta); err != nil {
-		log.Fatalf("write meta4: %v", err)
+	if len(failed) > 0 {
+		fmt.Printf("\nSkipped %d unreadable files:\n", len(failed))
+		for _, r := range failed {
+			fmt.Printf("  %s: %v\n", r.RelPath, r.Err)
+		}
+		return fmt.Errorf("%d files could not be read and were left out", len(failed))
+	}
+
+	if c.After != "" {
+		return c.runAfter(map[string]string{
+			"meta":     metaPath,
+			"torrent":  torPath,
+			"infohash": infohash,
+			"name":     artifactName,
+			"bundle":   c.Bundle,
+		})
+	}
+	return nil
+}
+
+// parseMirrors splits the "URL|conns=N" form of --mirrors into the URLs and
+// their connection limits, 0 where none is given
+func parseMirrors(specs []string) ([]string, []int, error) {
+	mirrors := make([]string, len(specs))
+	conns := make([]int, len(specs))
+	for i, spec := range specs {
+		u, params, ok := strings.Cut(spec, "|")
+		mirrors[i] = u
+		if !ok {
+			continue
+		}
+		for _, param := range strings.Split(params, ",") {
+			key, value, _ := strings.Cut(param, "=")
+			if key != "conns" {
+				return nil, nil, fmt.Errorf("mirror %s: unknown option %q, expected conns=N", u, param)
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, nil, fmt.Errorf("mirror %s: conns=%s is not a positive number", u, value)
+			}
+			conns[i] = n
+		}
 	}
+	return mirrors, conns, nil
+}
 
-	if CLI.Sign != "" {
-		sig, err := pgpDetachedArmorSign(metaPath, CLI.Sign)
+// walkTree lists the local or remote files to package, applying the walk
+// flags to opts
+func (c *GenerateCmd) walkTree(opts *metalink.Options) (metalink.Tree, error) {
+	if c.part != nil {
+		return *c.part, nil
+	}
+	opts.EmptyDirPlaceholder = c.EmptyDirPlaceholder
+	opts.RecordSymlinks = c.RecordSymlinks
+	opts.PreserveMode = c.PreserveMode
+	opts.MinFileSize = int64(c.MinFileSize)
+	opts.MaxFileSize = int64(c.MaxFileSize)
+	opts.MaxFiles = c.MaxFiles
+	opts.MaxTotalSize = int64(c.MaxTotalSize)
+	if !c.IncludeArtifacts && c.Path != "" {
+		opts.ExcludePaths = c.artifactPaths(filepath.Base(c.Path))
+	}
+	if c.ExcludeFrom != "" {
+		ignore, err := metalink.LoadIgnoreFile(c.ExcludeFrom)
 		if err != nil {
-			log.Fatalf("pgp sign failed: %v", err)
+			return metalink.Tree{}, fmt.Errorf("exclude-from: %w", err)
+		}
+		opts.Exclude = ignore
+	}
+
+	var tree metalink.Tree
+	var err error
+	switch {
+	case len(c.URL) > 0 && c.Path != "":
+		return tree, usageError(errors.New("give either a path or --url, not both"))
+	case len(c.URL) > 0:
+		tree, err = metalink.RemoteTree(c.URL, opts.HTTPClient)
+	case len(c.Map) > 0:
+		var mappings []metalink.FileMapping
+		for _, m := range c.Map {
+			// Messy source names are more likely to hold an = than the published ones
+			i := strings.LastIndex(m, "=")
+			if i <= 0 {
+				return tree, usageError(fmt.Errorf("map: %q is not SRC=PATH", m))
+			}
+			mappings = append(mappings, metalink.FileMapping{Source: m[:i], Path: m[i+1:]})
+		}
+		tree, err = metalink.MapTree(mappings, *opts)
+	case c.StdinTar:
+		opts.PieceSize = int64(c.PieceSize)
+		if opts.PieceSize == 0 {
+			opts.PieceSize = metalink.CalculatePieceSize(int64(c.Total))
 		}
-		meta.Signature = &MetaSignature{
-			Mediatype: "application/pgp-signature",
-			Value:     sig,
+		tree, c.tarResults, c.tarPieces, err = metalink.HashTar(os.Stdin, *opts)
+	case c.Path != "":
+		tree, err = metalink.Walk(c.Path, *opts)
+	default:
+		return tree, usageError(errors.New("a path, --url or --map is required"))
+	}
+	switch {
+	case errors.Is(err, metalink.ErrTooManyFiles):
+		return tree, fmt.Errorf("%s: %w; check the path, or raise --max-files", c.Path, err)
+	case errors.Is(err, metalink.ErrTooLarge):
+		return tree, fmt.Errorf("%s: %w; check the path, or raise --max-total-size", c.Path, err)
+	case err != nil:
+		return tree, err
+	}
+	if len(tree.Files) == 0 {
+		return tree, fmt.Errorf("no files found under %s", c.Path)
+	}
+	if c.Path != "" {
+		if err := c.handleLFSPointers(&tree); err != nil {
+			return tree, err
 		}
-		if err := writeMetaFile(metaPath, meta); err != nil {
-			log.Fatalf("write meta4 with signature: %v", err)
+	}
+	// A name that XML can't carry would be silently altered in the metalink
+	if c.SanitizeNames {
+		n, err := metalink.SanitizeNames(&tree)
+		if err != nil {
+			return tree, fmt.Errorf("sanitize-names: %w", err)
+		}
+		if n > 0 {
+			log.Printf("sanitize-names: renamed %d", n)
 		}
+	} else if err := metalink.CheckNames(tree); err != nil {
+		return tree, fmt.Errorf("%w; rename it or pass --sanitize-names", err)
+	}
+	if c.StdinTar {
+		// The pieces follow the tar's order already
+		return tree, nil
+	}
+	if err := metalink.SortFiles(&tree, c.SortFilesBy); err != nil {
+		return tree, err
+	}
+	return tree, nil
+}
+
+// outDir is --out-dir, or the directory containing the input
+func (c *GenerateCmd) outDir() string {
+	if c.OutDir != "" {
+		return c.OutDir
+	}
+	if c.Path == "" {
+		return "."
+	}
+	return filepath.Dir(c.Path)
+}
+
+// isInside reports whether dir is root or below it
+func isInside(dir, root string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absRoot, absDir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// metaOutDir is where the metalink and its piece hashes go
+func (c *GenerateCmd) metaOutDir() string {
+	if c.MetaOutDir != "" {
+		return c.MetaOutDir
+	}
+	return c.outDir()
+}
+
+// torrentOutDir is where the torrent goes
+func (c *GenerateCmd) torrentOutDir() string {
+	if c.TorrentOutDir != "" {
+		return c.TorrentOutDir
+	}
+	return c.outDir()
+}
+
+// artifactPaths lists the files a run for name can write
+func (c *GenerateCmd) artifactPaths(name string) []string {
+	var paths []string
+	for _, ext := range []string{".meta4", ".meta4.tmp", ".meta4.unsigned", ".meta4.asc", ".pieces"} {
+		paths = append(paths, filepath.Join(c.metaOutDir(), name+ext))
+	}
+	for _, ext := range []string{c.torrentExt(), c.torrentExt() + ".txt", c.torrentExt() + ".asc"} {
+		paths = append(paths, filepath.Join(c.torrentOutDir(), name+ext))
+	}
+	paths = append(paths, filepath.Join(c.outDir(), name+".errors.txt"), c.perFileDir(name))
+	if c.Bundle != "" {
+		paths = append(paths, c.Bundle, c.Bundle+".tmp")
+	}
+	if c.Checkpoint != "" {
+		paths = append(paths, c.Checkpoint, c.Checkpoint+".tmp")
+	}
+	if c.ChecksumCache != "" {
+		paths = append(paths, c.ChecksumCache, c.ChecksumCache+".tmp")
+	}
+	return paths
+}
+
+// handleLFSPointers resolves the Git LFS pointer files of tree with
+// --resolve-lfs, or warns about them
+func (c *GenerateCmd) handleLFSPointers(tree *metalink.Tree) error {
+	pointers, err := metalink.FindLFSPointers(*tree)
+	if err != nil {
+		return fmt.Errorf("looking for LFS pointers: %w", err)
+	}
+	if len(pointers) == 0 {
+		return nil
+	}
+	if !c.ResolveLFS {
+		log.Printf("warning: %d files are Git LFS pointers, such as %s; run git lfs pull or pass --resolve-lfs to package their content", len(pointers), tree.Files[pointers[0].Index].RelPath)
+		return nil
+	}
+	if err := metalink.ResolveLFS(tree, pointers); err != nil {
+		return fmt.Errorf("resolve-lfs: %w", err)
+	}
+	c.lfsOIDs = make(map[string]string, len(pointers))
+	for _, p := range pointers {
+		c.lfsOIDs[tree.Files[p.Index].RelPath] = p.OID
 	}
+	return nil
+}
 
-	fmt.Printf("\nGenerated:\n%s\n%s\n", metaPath, torPath)
+// removeTemp removes a temporary file unless --keep-temp
+func (c *GenerateCmd) removeTemp(path string) {
+	if !c.KeepTemp {
+		os.Remove(path)
+	}
 }
 
-func writeTorrentFile(path string, t Torrent) error {
-	f, err := os.Create(path)
+// copyFile copies src to dst, replacing it
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	if err := bencode.Marshal(f, t); err != nil {
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// torrentExt is what follows the package name in the torrent's file name
+func (c *GenerateCmd) torrentExt() string {
+	if c.TorrentNameSuffix == "" {
+		return ".torrent"
+	}
+	return "." + c.TorrentNameSuffix + ".torrent"
+}
+
+// writeMeta writes meta, in canonical form with --canonical
+func (c *GenerateCmd) writeMeta(path string, meta metalink.Metalink) error {
+	write := metalink.WriteMetaFile
+	if c.Canonical {
+		write = metalink.WriteCanonicalMetaFile
+	}
+	if err := write(path, meta); err != nil {
+		return err
+	}
+	return c.chmodOut(path)
+}
+
+// chmodOut applies --out-mode to a generated file. Directories, like that
+// of --per-file-metalinks, are left to mkdirOut.
+func (c *GenerateCmd) chmodOut(path string) error {
+	if c.OutMode == 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
 		return err
 	}
+	if err := os.Chmod(path, os.FileMode(c.OutMode)); err != nil {
+		return fmt.Errorf("out-mode: %w", err)
+	}
 	return nil
 }
 
-func writeMetaFile(path string, m Metalink) error {
-	out, err := xml.MarshalIndent(m, "", "  ")
+// writeOut writes a generated file that is complete in memory, created with
+// --out-mode so that it is never readable more widely than asked for
+func (c *GenerateCmd) writeOut(path string, data []byte) error {
+	mode := os.FileMode(0o644)
+	if c.OutMode != 0 {
+		mode = os.FileMode(c.OutMode)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
-	out = append([]byte(xml.Header), out...)
-	return os.WriteFile(path, out, 0o644)
+	// The mode only applies to a new file, reduced by the umask
+	if c.OutMode != 0 {
+		if err := f.Chmod(mode); err != nil {
+			f.Close()
+			return fmt.Errorf("out-mode: %w", err)
+		}
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-func pgpDetachedArmorSign(filePath string, keyname string) (string, error) {
-	args := []string{"--local-user", keyname, "--armor", "--detach-sign", "--output", "-", filePath}
+// mkdirOut creates an output directory and its missing parents, with
+// --out-dir-mode if given. Existing directories keep their permissions.
+func (c *GenerateCmd) mkdirOut(dir string) error {
+	if c.OutDirMode == 0 {
+		return os.MkdirAll(dir, 0o755)
+	}
+	var missing []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err := os.MkdirAll(dir, os.FileMode(c.OutDirMode)); err != nil {
+		return err
+	}
+	// MkdirAll's mode is reduced by the umask
+	for _, d := range missing {
+		if err := os.Chmod(d, os.FileMode(c.OutDirMode)); err != nil {
+			return fmt.Errorf("out-dir-mode: %w", err)
+		}
+	}
+	return nil
+}
+
+// signsMetalink and signsTorrent report whether --sign applies to each
+// artifact, as chosen by --sign-target
+func (c *GenerateCmd) signsMetalink() bool {
+	return c.Sign != "" && c.SignTarget != "torrent"
+}
+
+func (c *GenerateCmd) signsTorrent() bool {
+	return c.Sign != "" && c.SignTarget != "metalink"
+}
 
-	cmd := exec.Command("gpg", args...)
-	cmd.Stderr = os.Stderr
-	out, err := cmd.Output()
+// signDetached writes a detached armored signature of path to <path>.asc
+// and returns its path
+func (c *GenerateCmd) signDetached(path string) (string, error) {
+	sig, err := metalink.PGPDetachedArmorSignWith(path, c.Sign, metalink.GPGOptions{
+		Homedir: c.GPGHome,
+		Keyring: c.GPGKeyring,
+	})
 	if err != nil {
-		return "", fmt.Errorf("gpg failed: %w", err)
+		return "", exitError{fmt.Errorf("pgp sign %s failed: %w", filepath.Base(path), err), exitSign}
 	}
-	return strings.TrimSpace(string(out)), nil
+	sigPath := path + ".asc"
+	if err := c.writeOut(sigPath, []byte(sig+"\n")); err != nil {
+		return "", fmt.Errorf("write signature: %w", err)
+	}
+	return sigPath, nil
+}
+
+// sign adds a detached PGP signature of metaPath to meta and rewrites it, or
+// with --detached-signature writes it to <metaPath>.asc instead
+func (c *GenerateCmd) sign(metaPath string, meta *metalink.Metalink) error {
+	if c.DetachedSignature {
+		_, err := c.signDetached(metaPath)
+		return err
+	}
+	sig, err := metalink.PGPDetachedArmorSignWith(metaPath, c.Sign, metalink.GPGOptions{
+		Homedir: c.GPGHome,
+		Keyring: c.GPGKeyring,
+	})
+	if err != nil {
+		return exitError{fmt.Errorf("pgp sign failed: %w", err), exitSign}
+	}
+	mediatype := metalink.PGPSignatureMediatype
+	if c.SignatureMediatype != "" {
+		mediatype = c.SignatureMediatype
+	}
+	meta.Signature = &metalink.MetaSignature{
+		Mediatype: mediatype,
+		Value:     sig,
+	}
+	if c.LowMemory {
+		// The metalink was never held in memory as a whole
+		if err := metalink.AppendSignature(metaPath, *meta.Signature); err != nil {
+			return fmt.Errorf("write meta4 with signature: %w", err)
+		}
+		return nil
+	}
+	if err := c.writeMeta(metaPath, *meta); err != nil {
+		return fmt.Errorf("write meta4 with signature: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,710 @@
+package metalink
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+type MetalinkOptions struct {
+	Mirrors      []string
+	NoWrap       bool     // list directory contents at the root, without the directory name
+	FileVersions []string // VERSION or VERSION:GLOB, first match wins
+	TorrentName  string   // referenced as a metaurl when set
+	TorrentData  []byte   // bencoded torrent, embedded as a data: URI metaurl instead of TorrentName
+	NoPieces     bool     // omit per-file piece hashes, leaving piece verification to the torrent
+	FlatMirror   bool     // mirrors hold every file by its base name in one directory
+	Strict       bool     // fail on the first RFC 5854 violation; see strictChecker
+
+	// Added around the file name in mirror URLs (not the metalink name),
+	// for mirrors that store "file.iso" as "file.iso.bin"
+	MirrorPrefix string
+	MirrorSuffix string
+
+	// Where the metalink will be, for a URL relative to it for each local
+	// file, as for publishing the metalink together with the files. Not an
+	// IRI as RFC 5854 requires, so only clients that resolve relative
+	// references against the metalink's location can use it.
+	RelativeTo string
+
+	// Connection limit hints: MaxConnections for every file, and
+	// MirrorMaxConnections for the URLs of each of Mirrors (by index, 0 for
+	// none). See MetalinkFile.MaxConnections.
+	MaxConnections       int
+	MirrorMaxConnections []int
+
+	// Add each file's mediatype, from MimeMap by lowercase extension
+	// (".mp4") or else mime.TypeByExtension
+	MediaTypes bool
+	MimeMap    map[string]string
+
+	// Per-file piece hash types, "sha-256" and/or "sha-1", each listed in
+	// its own <pieces>. Empty means sha-256. SHA-1 needs Options.SHA1Pieces.
+	PieceHashTypes []string
+
+	RootHash bool // add a <root-hash> over the files; see RootHash
+
+	Published time.Time // omitted when zero
+
+	Logf func(format string, args ...any) // as in Options
+}
+
+type TorrentOptions struct {
+	Tracker  string
+	Mirrors  []string
+	WebSeeds []string // added to the url-list as-is, e.g. RemoteWebseeds
+	NoWrap   bool
+	Merkle   bool // BEP-30 "root hash" instead of "pieces"
+
+	// Mirrors hold every file by its base name, which webseeds can't
+	// express for directories, so they are left out of the url-list
+	FlatMirror bool
+
+	// As in MetalinkOptions. Only single-file webseeds can carry them, so
+	// directory mirrors are left out of the url-list.
+	MirrorPrefix string
+	MirrorSuffix string
+
+	CreationDate time.Time // omitted when zero
+
+	// BEP-12 announce-list. When set, the announce is the first tracker of
+	// the first tier instead of Tracker.
+	TrackerTiers [][]string
+
+	// Repeat the name and paths in the name.utf-8 and path.utf-8 keys, which
+	// some old clients read instead when the names aren't ASCII. The names
+	// are UTF-8 either way.
+	LegacyUTF8Name bool
+
+	Logf func(format string, args ...any) // as in Options
+}
+
+// BuildMetalink assembles a Metalink v4 document from the hash results
+func BuildMetalink(t Tree, results []FileHashResult, pieceLength int64, opts MetalinkOptions) (Metalink, error) {
+	meta, pieceTypes, err := metalinkHead(opts)
+	if err != nil {
+		return meta, err
+	}
+	var sc *strictChecker
+	if opts.Strict {
+		sc = newStrictChecker()
+		if err := sc.head(meta); err != nil {
+			return meta, fmt.Errorf("strict: %w", err)
+		}
+	}
+
+	warnFileMirrors(t, opts)
+
+	resultMap := make(map[string]FileHashResult)
+	for _, r := range results {
+		resultMap[r.RelPath] = r
+	}
+
+	for _, fi := range t.Files {
+		// Metalink has no notion of symlinks
+		if fi.Symlink != "" {
+			continue
+		}
+		mf, err := metalinkFile(t, fi, resultMap[fi.RelPath], pieceLength, pieceTypes, opts)
+		if err != nil {
+			return meta, err
+		}
+		if sc != nil {
+			if err := sc.file(mf); err != nil {
+				return meta, fmt.Errorf("strict: %w", err)
+			}
+		}
+		meta.Files = append(meta.Files, mf)
+	}
+	if sc != nil {
+		if err := sc.end(); err != nil {
+			return meta, fmt.Errorf("strict: %w", err)
+		}
+	}
+	if opts.RootHash {
+		root, err := RootHash(meta.Files)
+		if err != nil {
+			return meta, fmt.Errorf("root hash: %w", err)
+		}
+		meta.RootHash = &MetaHash{Type: RootHashType, Value: root}
+	}
+	return meta, nil
+}
+
+// metalinkHead returns the document without files and the piece hash types
+// to list for each file
+func metalinkHead(opts MetalinkOptions) (Metalink, []string, error) {
+	meta := Metalink{
+		XMLNs:   "urn:ietf:params:xml:ns:metalink",
+		Version: "4.0",
+	}
+
+	if !opts.Published.IsZero() {
+		meta.Published = opts.Published.UTC().Format(time.RFC3339)
+	}
+
+	switch {
+	case len(opts.TorrentData) > 0:
+		meta.Metaurls = []MetaURL{
+			{Priority: 1, MediaType: "application/x-bittorrent", Value: "data:application/x-bittorrent;base64," + base64.StdEncoding.EncodeToString(opts.TorrentData)},
+		}
+	case opts.TorrentName != "":
+		meta.Metaurls = []MetaURL{
+			{Priority: 1, MediaType: "application/x-bittorrent", Value: opts.TorrentName},
+		}
+	}
+
+	pieceTypes := opts.PieceHashTypes
+	if len(pieceTypes) == 0 {
+		pieceTypes = []string{"sha-256"}
+	}
+	for _, typ := range pieceTypes {
+		if typ != "sha-256" && typ != "sha-1" {
+			return meta, nil, fmt.Errorf("unsupported piece hash type %s", typ)
+		}
+	}
+	if opts.NoPieces {
+		pieceTypes = nil
+	}
+	return meta, pieceTypes, nil
+}
+
+// metalinkFile builds the <file> entry of fi from its hash result
+func metalinkFile(t Tree, fi FileInfo, r FileHashResult, pieceLength int64, pieceTypes []string, opts MetalinkOptions) (MetalinkFile, error) {
+	relPath := metalinkName(fi.RelPath, t.Name, t.IsDir && !opts.NoWrap)
+
+	// Placeholders only exist in the output, so no mirror has them
+	var urls []MetalinkURL
+	if fi.URL != "" {
+		urls = append(urls, MetalinkURL{Value: fi.URL})
+	}
+	if !fi.Placeholder {
+		mirrorName := relPath
+		if opts.FlatMirror && t.IsDir {
+			mirrorName = path.Base(fi.RelPath)
+		}
+		mirrorName = affixBase(mirrorName, opts.MirrorPrefix, opts.MirrorSuffix)
+		mirrorURLs, err := fileMirrorURLs(opts.Mirrors, mirrorName, t.IsDir)
+		if err != nil {
+			return MetalinkFile{}, err
+		}
+		for i, u := range mirrorURLs {
+			mu := MetalinkURL{Value: u}
+			if i < len(opts.MirrorMaxConnections) {
+				mu.MaxConnections = opts.MirrorMaxConnections[i]
+			}
+			urls = append(urls, mu)
+		}
+		if opts.RelativeTo != "" && fi.URL == "" {
+			u, err := relativeURL(t, fi, opts.RelativeTo)
+			if err != nil {
+				return MetalinkFile{}, fmt.Errorf("%s: %w", fi.RelPath, err)
+			}
+			urls = append(urls, MetalinkURL{Value: u})
+		}
+	}
+	for i := range urls {
+		urls[i].Priority = i + 1
+	}
+
+	mf := MetalinkFile{
+		Name:    relPath,
+		Size:    r.Size,
+		Version: fileVersion(opts.FileVersions, fi.RelPath),
+		Hash: MetaHash{
+			Type:  "sha-256",
+			Value: r.FileSHA256,
+		},
+		URLs: urls,
+
+		MaxConnections: opts.MaxConnections,
+	}
+	if opts.MediaTypes {
+		mf.MediaType = mediaType(fi.RelPath, opts.MimeMap)
+	}
+	for _, typ := range pieceTypes {
+		hashes := r.PieceHashes
+		if typ == "sha-1" {
+			hashes = r.SHA1PieceHashes
+			if hashes == nil && r.Size > 0 {
+				return mf, fmt.Errorf("%s: no SHA-1 piece hashes; hash with Options.SHA1Pieces", fi.RelPath)
+			}
+		}
+		metaPieceHashes := make([]MetaPieceHash, len(hashes))
+		for i, h := range hashes {
+			metaPieceHashes[i] = MetaPieceHash{
+				Type:  typ,
+				Value: h,
+			}
+		}
+		mf.Pieces = append(mf.Pieces, MetaPieces{
+			Type:   typ,
+			Length: pieceLength,
+			Hashes: metaPieceHashes,
+		})
+	}
+	// Coarser or finer lists follow the main ones, each in its own <pieces>
+	if len(pieceTypes) > 0 {
+		for _, extra := range r.ExtraPieces {
+			pieces := MetaPieces{Type: "sha-256", Length: extra.Length}
+			for _, h := range extra.Hashes {
+				pieces.Hashes = append(pieces.Hashes, MetaPieceHash{Type: "sha-256", Value: h})
+			}
+			mf.Pieces = append(mf.Pieces, pieces)
+		}
+	}
+	return mf, nil
+}
+
+// BuildTorrent assembles a BitTorrent v1 torrent with the mirrors as web seeds
+func BuildTorrent(t Tree, pieces TorrentPieces, opts TorrentOptions) (Torrent, error) {
+	tor := Torrent{
+		Announce: opts.Tracker,
+		Info: TorrentInfo{
+			PieceLength: pieces.PieceLength,
+			Pieces:      string(pieces.Hashes),
+			Name:        t.Name,
+		},
+	}
+
+	if !opts.CreationDate.IsZero() {
+		tor.CreationDate = opts.CreationDate.Unix()
+	}
+	if opts.LegacyUTF8Name {
+		tor.Info.NameUTF8 = tor.Info.Name
+	}
+
+	if len(opts.TrackerTiers) > 0 {
+		for i, tier := range opts.TrackerTiers {
+			if len(tier) == 0 {
+				return tor, fmt.Errorf("tracker tier %d is empty", i+1)
+			}
+		}
+		tor.Announce = opts.TrackerTiers[0][0]
+		tor.AnnounceList = opts.TrackerTiers
+	}
+	warnTrackerSchemes(tor, opts)
+
+	if opts.Merkle {
+		tor.Info.RootHash = string(MerkleRoot(pieces.Hashes))
+		tor.Info.Pieces = ""
+	}
+
+	// Add web seeds (mirrors) to torrent
+	affixed := opts.MirrorPrefix != "" || opts.MirrorSuffix != ""
+	if len(opts.Mirrors) > 0 && opts.FlatMirror && t.IsDir {
+		logf(opts.Logf, "warning: flat mirrors don't match the torrent's directory layout, leaving them out of the url-list")
+	} else if len(opts.Mirrors) > 0 && affixed && t.IsDir {
+		logf(opts.Logf, "warning: webseeds can't rename files with a mirror prefix or suffix, leaving the mirrors out of the url-list")
+	} else if len(opts.Mirrors) > 0 {
+		if t.IsDir {
+			// For multi-file torrents, mirrors should be base URLs
+			// the "url-list" must be a root folder where a client could add the "name" and "path/file"
+			for _, m := range opts.Mirrors {
+				if opts.NoWrap {
+					// Clients always append "name", so the webseed is the
+					// mirror's parent, which only works if the mirror is named
+					// like the directory
+					parent, ok := parentMirrorURL(m, t.Name)
+					if !ok {
+						logf(opts.Logf, "warning: mirror %s does not end in /%s/, omitting it from the torrent url-list", m, t.Name)
+						continue
+					}
+					tor.URLList = append(tor.URLList, parent)
+					continue
+				}
+				u, err := JoinMirrorURL(m, "")
+				if err != nil {
+					return tor, fmt.Errorf("mirror %s: %w", m, err)
+				}
+				tor.URLList = append(tor.URLList, u)
+			}
+		} else {
+			// For single-file torrents, mirrors should be full URLs to the file
+			mirrorName := affixBase(t.Name, opts.MirrorPrefix, opts.MirrorSuffix)
+			tor.URLList = make([]string, len(opts.Mirrors))
+			for i, m := range opts.Mirrors {
+				if strings.HasSuffix(m, mirrorName) {
+					tor.URLList[i] = m
+				} else {
+					var err error
+					tor.URLList[i], err = JoinMirrorURL(m, mirrorName)
+					if err != nil {
+						return tor, fmt.Errorf("mirror %s: %w", m, err)
+					}
+				}
+			}
+		}
+	}
+
+	tor.URLList = append(tor.URLList, opts.WebSeeds...)
+
+	if t.IsDir {
+		var tFiles []TorrentFileInfo
+		for _, fi := range t.Files {
+			p, err := torrentPath(fi.RelPath)
+			if err != nil {
+				return tor, err
+			}
+			tf := TorrentFileInfo{
+				Length: fi.Size,
+				Path:   p,
+			}
+			if fi.Executable {
+				tf.Attr = "x"
+			}
+			if opts.LegacyUTF8Name {
+				tf.PathUTF8 = p
+			}
+			if fi.Symlink != "" {
+				tf.Attr = "l"
+				if tf.SymlinkPath, err = torrentPath(fi.Symlink); err != nil {
+					return tor, fmt.Errorf("symlink %s: %w", fi.RelPath, err)
+				}
+			}
+			tFiles = append(tFiles, tf)
+		}
+		tor.Info.Files = tFiles
+	} else {
+		tor.Info.Length = t.Files[0].Size
+		if t.Files[0].Executable {
+			tor.Info.Attr = "x"
+		}
+	}
+	return tor, nil
+}
+
+// torrentPath splits the slash-separated relPath (see FileInfo.RelPath) into
+// torrent path components. A backslash would be a separator to Windows
+// clients, so it is refused rather than passed through.
+func torrentPath(relPath string) ([]string, error) {
+	parts := strings.Split(relPath, "/")
+	for _, p := range parts {
+		switch {
+		case p == "" || p == "." || p == "..":
+			return nil, fmt.Errorf("%q has an empty, . or .. path component", relPath)
+		case strings.Contains(p, `\`):
+			return nil, fmt.Errorf("%q contains a backslash, which Windows clients would take as a path separator", relPath)
+		}
+	}
+	return parts, nil
+}
+
+// metalinkName is the file name used in the metalink: the relative path,
+// prefixed with the directory name when wrapped
+func metalinkName(relPath string, baseName string, wrap bool) string {
+	if wrap {
+		return baseName + "/" + relPath
+	}
+	return relPath
+}
+
+// mediaType guesses the content type of relPath from its extension; empty
+// when unknown
+func mediaType(relPath string, mimeMap map[string]string) string {
+	ext := strings.ToLower(path.Ext(relPath))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := mimeMap[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// FlatCollisions groups the files that share a base name, which a flat
+// mirror would serve from the same URL
+func FlatCollisions(t Tree) [][]string {
+	byName := make(map[string][]string)
+	var names []string
+	for _, fi := range t.Files {
+		if fi.Placeholder || fi.Symlink != "" {
+			continue
+		}
+		base := path.Base(fi.RelPath)
+		if byName[base] == nil {
+			names = append(names, base)
+		}
+		byName[base] = append(byName[base], fi.RelPath)
+	}
+
+	var groups [][]string
+	for _, name := range names {
+		if len(byName[name]) > 1 {
+			groups = append(groups, byName[name])
+		}
+	}
+	return groups
+}
+
+// fileVersion returns the version of the first VERSION[:GLOB] spec matching
+// relPath. Globs without a slash match the base name.
+func fileVersion(specs []string, relPath string) string {
+	for _, spec := range specs {
+		version, pattern, ok := strings.Cut(spec, ":")
+		if !ok {
+			return version
+		}
+		name := relPath
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(relPath)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return version
+		}
+	}
+	return ""
+}
+
+// ValidateFileVersions checks the glob of each VERSION:GLOB spec
+func ValidateFileVersions(specs []string) error {
+	for _, fv := range specs {
+		if _, pattern, ok := strings.Cut(fv, ":"); ok {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("file-version %s: %w", fv, err)
+			}
+		}
+	}
+	return nil
+}
+
+// affixBase adds prefix and suffix to the last segment of the slash-separated
+// name
+func affixBase(name, prefix, suffix string) string {
+	if prefix == "" && suffix == "" {
+		return name
+	}
+	dir, base := path.Split(name)
+	return dir + prefix + base + suffix
+}
+
+// fileMirrorURLs returns the URL of the named file on each mirror. For a
+// single file a mirror that already ends with the name is used as-is.
+func fileMirrorURLs(mirrors []string, name string, isDir bool) ([]string, error) {
+	var urls []string
+	for _, m := range mirrors {
+		u := m
+		if isDir || !strings.HasSuffix(m, name) {
+			var err error
+			u, err = JoinMirrorURL(m, name)
+			if err != nil {
+				return nil, fmt.Errorf("mirror %s: %w", m, err)
+			}
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// relativeURL is the relative reference from the directory dir to the local
+// file fi, under its name in the package
+func relativeURL(t Tree, fi FileInfo, dir string) (string, error) {
+	if t.FS != nil || t.Root == "" {
+		return "", errors.New("relative URLs need files on disk")
+	}
+	p := t.Root
+	if t.IsDir {
+		p = filepath.Join(t.Root, filepath.FromSlash(fi.RelPath))
+	}
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil {
+		return "", err
+	}
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	u := strings.Join(segments, "/")
+	// A first segment like "a:b" would read as a scheme
+	if strings.Contains(segments[0], ":") {
+		u = "./" + u
+	}
+	return u, nil
+}
+
+// CheckWebseeds verifies that each file maps to at least one mirror URL that
+// HTTP/FTP clients can fetch
+func CheckWebseeds(t Tree, mirrors []string, wrap bool) error {
+	for _, fi := range t.Files {
+		if fi.Placeholder || fi.Symlink != "" {
+			continue
+		}
+		name := metalinkName(fi.RelPath, t.Name, t.IsDir && wrap)
+		urls, err := fileMirrorURLs(mirrors, name, t.IsDir)
+		if err != nil {
+			return err
+		}
+		if fi.URL != "" {
+			urls = append(urls, fi.URL)
+		}
+
+		reachable := false
+		for _, u := range urls {
+			parsed, err := url.Parse(u)
+			if err != nil {
+				continue
+			}
+			switch parsed.Scheme {
+			case "http", "https", "ftp":
+				if parsed.Host != "" {
+					reachable = true
+				}
+			}
+		}
+		if !reachable {
+			return fmt.Errorf("%s is not reachable from any mirror", fi.RelPath)
+		}
+	}
+	return nil
+}
+
+// JoinMirrorURL treats base as a directory URL and appends the slash-separated
+// relPath to it, escaping each path segment with url.PathEscape. Query strings and fragments on
+// base are preserved. An empty relPath returns base with a trailing slash.
+func JoinMirrorURL(base string, relPath string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u = u.JoinPath("/")
+	}
+	if relPath == "" {
+		return u.String(), nil
+	}
+
+	// Percent-encode each segment on its own so that characters like '#' and
+	// '?' in file names can't be mistaken for URL delimiters
+	segments := strings.Split(relPath, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	u.RawPath = u.EscapedPath() + strings.Join(segments, "/")
+	u.Path += relPath
+	return u.String(), nil
+}
+
+// warnFileMirrors warns about directory mirrors that look like the URL of
+// one of the files, which would get the file's path appended a second time
+func warnFileMirrors(t Tree, opts MetalinkOptions) {
+	if !t.IsDir || len(opts.Mirrors) == 0 {
+		return
+	}
+	names := make(map[string]string)
+	for _, fi := range t.Files {
+		base := path.Base(fi.RelPath)
+		names[base] = fi.RelPath
+		names[affixBase(base, opts.MirrorPrefix, opts.MirrorSuffix)] = fi.RelPath
+	}
+	for _, m := range opts.Mirrors {
+		u, err := url.Parse(m)
+		if err != nil || strings.HasSuffix(u.Path, "/") {
+			continue
+		}
+		if relPath, ok := names[path.Base(u.Path)]; ok {
+			logf(opts.Logf, "warning: mirror %s looks like the URL of %s, but directory mirrors are base URLs that each file's path is appended to", m, relPath)
+		}
+	}
+}
+
+// parentMirrorURL returns the directory containing base if the last path
+// segment of base is name
+func parentMirrorURL(base string, name string) (string, bool) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", false
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	if path.Base(p) != name {
+		return "", false
+	}
+	u.Path = path.Dir(p)
+	u.RawPath = ""
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String(), true
+}
+
+// trackerSchemes are the announce URL schemes clients know: HTTP(S) (BEP 3),
+// UDP (BEP 15) and WebSocket for WebTorrent
+var trackerSchemes = []string{"http", "https", "udp", "ws", "wss"}
+
+// warnTrackerSchemes warns about announce URLs that no client will use,
+// such as a tracker given without its scheme
+func warnTrackerSchemes(tor Torrent, opts TorrentOptions) {
+	trackers := []string{tor.Announce}
+	for _, tier := range tor.AnnounceList {
+		trackers = append(trackers, tier...)
+	}
+	seen := make(map[string]bool)
+	for _, tr := range trackers {
+		if tr == "" || seen[tr] {
+			continue
+		}
+		seen[tr] = true
+		u, err := url.Parse(tr)
+		if err != nil {
+			logf(opts.Logf, "warning: tracker %s is not a valid URL: %v", tr, err)
+			continue
+		}
+		if !slices.Contains(trackerSchemes, strings.ToLower(u.Scheme)) {
+			logf(opts.Logf, "warning: tracker %s does not start with %s://, which clients may not announce to", tr, strings.Join(trackerSchemes, "://, "))
+		}
+	}
+}
+
+// MerkleRoot builds a BEP-30 SHA-1 hash tree over the concatenated piece
+// hashes and returns the root. Leaves beyond the last piece, up to the next
+// power of two, are zero-filled.
+func MerkleRoot(pieces []byte) []byte {
+	n := len(pieces) / sha1.Size
+	if n == 0 {
+		return make([]byte, sha1.Size)
+	}
+
+	width := 1
+	for width < n {
+		width *= 2
+	}
+	layer := make([]byte, width*sha1.Size)
+	copy(layer, pieces)
+
+	for width > 1 {
+		width /= 2
+		next := make([]byte, width*sha1.Size)
+		for i := 0; i < width; i++ {
+			sum := sha1.Sum(layer[2*i*sha1.Size : (2*i+2)*sha1.Size])
+			copy(next[i*sha1.Size:], sum[:])
+		}
+		layer = next
+	}
+	return layer
+}
+
+// InfoHash is the BitTorrent v1 infohash: the SHA-1 of the bencoded info dict
+func InfoHash(info TorrentInfo) ([]byte, error) {
+	h := sha1.New()
+	if err := bencode.Marshal(h, info.encoded()); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
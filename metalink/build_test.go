@@ -0,0 +1,126 @@
+package metalink
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestJoinMirrorURL(t *testing.T) {
+	tests := []struct {
+		base, relPath, want string
+	}{
+		{"https://example.com/pub/", "café déjà #1.bin", "https://example.com/pub/caf%C3%A9%20d%C3%A9j%C3%A0%20%231.bin"},
+		{"https://example.com/pub", "dir/café déjà #1.bin", "https://example.com/pub/dir/caf%C3%A9%20d%C3%A9j%C3%A0%20%231.bin"},
+		{"https://example.com/pub/", "what?.txt", "https://example.com/pub/what%3F.txt"},
+		{"https://example.com/a%20b/", "c d", "https://example.com/a%20b/c%20d"},
+		{"https://example.com/pub/?token=x", "a/b", "https://example.com/pub/a/b?token=x"},
+		{"https://example.com/pub", "", "https://example.com/pub/"},
+	}
+	for _, tt := range tests {
+		got, err := JoinMirrorURL(tt.base, tt.relPath)
+		if err != nil {
+			t.Errorf("JoinMirrorURL(%q, %q): %v", tt.base, tt.relPath, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("JoinMirrorURL(%q, %q) = %q, want %q", tt.base, tt.relPath, got, tt.want)
+		}
+	}
+}
+
+// TestTorrentPaths packages a nested directory and checks that the torrent
+// path components carry no separators. A Windows-style relative path, as a
+// walk that didn't normalize separators would produce, must be refused.
+func TestTorrentPaths(t *testing.T) {
+	fsys := fstest.MapFS{"a/b/c/d.bin": &fstest.MapFile{Data: []byte("nested"), Mode: 0o644}}
+	tree, err := WalkFS(fsys, "tree", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pieces, err := HashFiles(tree, Options{PieceSize: 16 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, err := BuildTorrent(tree, pieces, TorrentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tor.Info.Files) != 1 || !slices.Equal(tor.Info.Files[0].Path, []string{"a", "b", "c", "d.bin"}) {
+		t.Errorf("torrent paths %v, expected [[a b c d.bin]]", tor.Info.Files)
+	}
+
+	tree.Files[0].RelPath = `a\b\c\d.bin`
+	if _, err := BuildTorrent(tree, pieces, TorrentOptions{}); err == nil {
+		t.Error("a backslash-separated path was accepted")
+	}
+}
+
+// TestTorrentUTF8Names packages a directory with CJK names and checks that
+// the torrent carries them as UTF-8, repeated in name.utf-8 and path.utf-8
+// with LegacyUTF8Name only
+func TestTorrentUTF8Names(t *testing.T) {
+	const name, file = "リリース", "文档/说明.txt"
+	fsys := fstest.MapFS{file: &fstest.MapFile{Data: []byte("内容"), Mode: 0o644}}
+	tree, err := WalkFS(fsys, name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pieces, err := HashFiles(tree, Options{PieceSize: 16 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, legacy := range []bool{false, true} {
+		tor, err := BuildTorrent(tree, pieces, TorrentOptions{LegacyUTF8Name: legacy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := MarshalTorrent(tor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(data, []byte(fmt.Sprintf("4:name%d:%s", len(name), name))) {
+			t.Error("the torrent name isn't written as UTF-8")
+		}
+		if bytes.Contains(data, []byte("name.utf-8")) != legacy || bytes.Contains(data, []byte("path.utf-8")) != legacy {
+			t.Errorf("name.utf-8 and path.utf-8 should be written only with LegacyUTF8Name (%t)", legacy)
+		}
+		back, err := UnmarshalTorrent(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"文档", "说明.txt"}
+		if back.Info.Name != name || len(back.Info.Files) != 1 || !slices.Equal(back.Info.Files[0].Path, want) {
+			t.Fatalf("torrent names %q %v, expected %q [%v]", back.Info.Name, back.Info.Files, name, want)
+		}
+		if legacy && (back.Info.NameUTF8 != name || !slices.Equal(back.Info.Files[0].PathUTF8, want)) {
+			t.Errorf("name.utf-8 %q and path.utf-8 %v, expected %q and %v", back.Info.NameUTF8, back.Info.Files[0].PathUTF8, name, want)
+		}
+	}
+}
+
+func TestTorrentPiecesKey(t *testing.T) {
+	tree := Tree{Name: "d", IsDir: true, Files: []FileInfo{{RelPath: "x"}}}
+	pieces := TorrentPieces{PieceLength: 256 * 1024}
+
+	for _, merkle := range []bool{false, true} {
+		tor, err := BuildTorrent(tree, pieces, TorrentOptions{Merkle: merkle})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := MarshalTorrent(tor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// BEP 3 requires pieces even with no content; BEP 30 replaces it
+		hasPieces := strings.Contains(string(b), "6:pieces0:")
+		hasRoot := strings.Contains(string(b), "9:root hash20:")
+		if hasPieces == merkle || hasRoot != merkle {
+			t.Errorf("merkle %t: got %q", merkle, b)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package metalink
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// HashCache remembers the hash results of local files across runs, keyed by
+// absolute path, size and modification time, so that unchanged files needn't
+// be read again. The torrent pieces span file boundaries, so they are kept
+// for the last tree as a whole and only reused when none of it has changed.
+type HashCache struct {
+	files  map[string]cacheEntry
+	pieces cachedPieces
+}
+
+// cacheFile is the JSON form of a HashCache
+type cacheFile struct {
+	Files  map[string]cacheEntry
+	Pieces cachedPieces
+}
+
+type cacheEntry struct {
+	Size    int64
+	ModTime int64
+	Config  string // see cacheConfig
+	Result  FileHashResult
+}
+
+type cachedPieces struct {
+	Tree   string // see treeSignature
+	Pieces TorrentPieces
+}
+
+// LoadHashCache reads the cache at path, or starts an empty one if it
+// doesn't exist yet
+func LoadHashCache(path string) (*HashCache, error) {
+	c := &HashCache{files: make(map[string]cacheEntry)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cf cacheFile
+	if err := json.Unmarshal(b, &cf); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cf.Files != nil {
+		c.files = cf.Files
+	}
+	c.pieces = cf.Pieces
+	return c, nil
+}
+
+// Save writes the cache to path
+func (c *HashCache) Save(path string) error {
+	b, err := json.Marshal(cacheFile{Files: c.files, Pieces: c.pieces})
+	if err != nil {
+		return err
+	}
+	// Write-then-rename so an interrupted save never leaves a truncated cache
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Lookup returns the cached result of each file of t, in order, and the
+// indexes of the files that have none or whose size or modification time
+// changed. Remote files and trees read from an fs.FS are never cached.
+func (c *HashCache) Lookup(t Tree, opts Options) (results []FileHashResult, missing []int) {
+	config := cacheConfig(opts)
+	results = make([]FileHashResult, len(t.Files))
+	for i, fi := range t.Files {
+		key, ok := cacheKey(t, fi)
+		e, found := c.files[key]
+		if !ok || !found || e.Size != fi.Size || e.ModTime != fi.ModTime || e.Config != config {
+			missing = append(missing, i)
+			continue
+		}
+		results[i] = e.Result
+		results[i].RelPath = fi.RelPath
+	}
+	return results, missing
+}
+
+// Pieces returns the cached torrent pieces if they were computed for exactly
+// the files of t, in the same order
+func (c *HashCache) Pieces(t Tree, opts Options) (TorrentPieces, bool) {
+	sig, ok := treeSignature(t, opts)
+	if !ok || c.pieces.Tree != sig {
+		return TorrentPieces{}, false
+	}
+	return c.pieces.Pieces, true
+}
+
+// Update records the results of the files of t, except those that failed.
+// pieces may be nil when the torrent pieces weren't computed for the whole
+// of t.
+func (c *HashCache) Update(t Tree, results []FileHashResult, pieces *TorrentPieces, opts Options) {
+	config := cacheConfig(opts)
+	for i, fi := range t.Files {
+		key, ok := cacheKey(t, fi)
+		if !ok || results[i].Err != nil {
+			continue
+		}
+		c.files[key] = cacheEntry{Size: fi.Size, ModTime: fi.ModTime, Config: config, Result: results[i]}
+	}
+	if pieces == nil {
+		return
+	}
+	if sig, ok := treeSignature(t, opts); ok {
+		c.pieces = cachedPieces{Tree: sig, Pieces: *pieces}
+	}
+}
+
+// cacheKey is the absolute path fi is read from
+func cacheKey(t Tree, fi FileInfo) (string, bool) {
+	if fi.URL != "" || (t.FS != nil && fi.Source == "") {
+		return "", false
+	}
+	key, err := filepath.Abs(t.FullPath(fi))
+	if err != nil {
+		return "", false
+	}
+	if fi.Placeholder || fi.Symlink != "" {
+		// Not read from disk, but cached like the rest for the whole-tree check
+		key += "\x00" + fi.RelPath
+	}
+	return key, true
+}
+
+// cacheConfig sums up the options that change a file's hash results
+func cacheConfig(opts Options) string {
+	return fmt.Sprintf("%d %t %v", opts.PieceSize, opts.SHA1Pieces, opts.ExtraPieceSizes)
+}
+
+// treeSignature identifies the files of t, their order and the piece size,
+// which together determine the torrent pieces
+func treeSignature(t Tree, opts Options) (string, bool) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", opts.PieceSize)
+	for _, fi := range t.Files {
+		key, ok := cacheKey(t, fi)
+		if !ok {
+			return "", false
+		}
+		fmt.Fprintf(h, "%q %q %d %d\n", key, fi.RelPath, fi.Size, fi.ModTime)
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
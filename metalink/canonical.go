@@ -0,0 +1,140 @@
+package metalink
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// xmlNode is an element of a document being canonicalized. Elements hold
+// either text or children; metalinks have no mixed content.
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	text     strings.Builder
+	children []*xmlNode
+}
+
+// Canonicalize rewrites an XML document into a fixed form that doesn't
+// depend on the encoder: the XML declaration, attributes sorted by name
+// (namespace declarations first), two-space indentation, LF line endings,
+// whitespace between elements dropped, text-only elements on one line, and
+// C14N escaping. Comments and processing instructions are removed.
+func Canonicalize(doc []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	var root *xmlNode
+	var stack []*xmlNode
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: qualifiedName(tok.Name), attrs: slices.Clone(tok.Attr)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root != nil {
+				return nil, errors.New("more than one root element")
+			} else {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, errors.New("unbalanced end element")
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(tok)
+			}
+		}
+	}
+	if root == nil || len(stack) > 0 {
+		return nil, errors.New("incomplete document")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	if err := writeCanonical(&buf, root, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, n *xmlNode, depth int) error {
+	indent := strings.Repeat("  ", depth)
+	buf.WriteString(indent + "<" + n.name)
+
+	slices.SortFunc(n.attrs, func(a, b xml.Attr) int {
+		an, bn := qualifiedName(a.Name), qualifiedName(b.Name)
+		if ans, bns := isNamespaceDecl(a.Name), isNamespaceDecl(b.Name); ans != bns {
+			if ans {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(an, bn)
+	})
+	for _, a := range n.attrs {
+		buf.WriteString(" " + qualifiedName(a.Name) + `="` + canonicalAttrReplacer.Replace(a.Value) + `"`)
+	}
+	buf.WriteString(">")
+
+	text := n.text.String()
+	if len(n.children) > 0 {
+		if strings.TrimSpace(text) != "" {
+			return errors.New(n.name + ": mixed content is not supported")
+		}
+		buf.WriteString("\n")
+		for _, child := range n.children {
+			if err := writeCanonical(buf, child, depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(indent)
+	} else {
+		buf.WriteString(canonicalTextReplacer.Replace(text))
+	}
+	buf.WriteString("</" + n.name + ">\n")
+	return nil
+}
+
+func qualifiedName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+func isNamespaceDecl(n xml.Name) bool {
+	return n.Space == "xmlns" || (n.Space == "" && n.Local == "xmlns")
+}
+
+// Escaping as in Canonical XML 1.0
+var (
+	canonicalTextReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	canonicalAttrReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+// WriteCanonicalMetaFile writes m in the form produced by Canonicalize
+func WriteCanonicalMetaFile(path string, m Metalink) error {
+	out, err := xml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	out, err = Canonicalize(out)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0o644)
+}
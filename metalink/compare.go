@@ -0,0 +1,181 @@
+package metalink
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// FileChange is a file present in both metalinks with different content
+type FileChange struct {
+	Name    string `json:"name"`
+	OldSize int64  `json:"old_size"`
+	NewSize int64  `json:"new_size"`
+	OldHash string `json:"old_sha256"`
+	NewHash string `json:"new_sha256"`
+}
+
+// Rename is a file that moved without changing content
+type Rename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// MetalinkDiff lists what changed from one metalink to another. Files are
+// matched by name and, for renames, by SHA-256.
+type MetalinkDiff struct {
+	Added        []string     `json:"added,omitempty"`
+	Removed      []string     `json:"removed,omitempty"`
+	Changed      []FileChange `json:"changed,omitempty"`
+	Renamed      []Rename     `json:"renamed,omitempty"`
+	OldPieceSize []int64      `json:"old_piece_sizes,omitempty"` // set when the piece sizes differ
+	NewPieceSize []int64      `json:"new_piece_sizes,omitempty"`
+	OldTrackers  []string     `json:"old_trackers,omitempty"` // set when the trackers differ
+	NewTrackers  []string     `json:"new_trackers,omitempty"`
+}
+
+// Empty reports whether the metalinks are equivalent
+func (d MetalinkDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Renamed) == 0 &&
+		d.OldPieceSize == nil && d.NewPieceSize == nil && d.OldTrackers == nil && d.NewTrackers == nil
+}
+
+// CompareMetalinks diffs the files and piece sizes of two metalinks. Trackers
+// are compared when both torrents are given; pass nil to skip them.
+func CompareMetalinks(a, b Metalink, aTor, bTor *Torrent) MetalinkDiff {
+	var d MetalinkDiff
+
+	aFiles := make(map[string]MetalinkFile)
+	for _, mf := range a.Files {
+		aFiles[mf.Name] = mf
+	}
+	bFiles := make(map[string]MetalinkFile)
+	for _, mf := range b.Files {
+		bFiles[mf.Name] = mf
+	}
+
+	for _, mf := range a.Files {
+		nf, ok := bFiles[mf.Name]
+		if !ok {
+			d.Removed = append(d.Removed, mf.Name)
+			continue
+		}
+		if nf.Size != mf.Size || nf.Hash != mf.Hash {
+			d.Changed = append(d.Changed, FileChange{
+				Name:    mf.Name,
+				OldSize: mf.Size,
+				NewSize: nf.Size,
+				OldHash: mf.Hash.Value,
+				NewHash: nf.Hash.Value,
+			})
+		}
+	}
+	for _, mf := range b.Files {
+		if _, ok := aFiles[mf.Name]; !ok {
+			d.Added = append(d.Added, mf.Name)
+		}
+	}
+
+	// A removed and an added file with the same content are a rename. Empty
+	// files all hash alike, so they are left as they are.
+	added := make(map[MetaHash][]string)
+	for _, name := range d.Added {
+		if mf := bFiles[name]; mf.Size > 0 {
+			added[mf.Hash] = append(added[mf.Hash], name)
+		}
+	}
+	var removed []string
+	renamedTo := make(map[string]bool)
+	for _, name := range d.Removed {
+		mf := aFiles[name]
+		if candidates := added[mf.Hash]; mf.Size > 0 && len(candidates) > 0 {
+			d.Renamed = append(d.Renamed, Rename{From: name, To: candidates[0]})
+			renamedTo[candidates[0]] = true
+			added[mf.Hash] = candidates[1:]
+			continue
+		}
+		removed = append(removed, name)
+	}
+	d.Removed = removed
+	d.Added = slices.DeleteFunc(d.Added, func(name string) bool { return renamedTo[name] })
+
+	aSizes, bSizes := pieceSizes(a), pieceSizes(b)
+	if !slices.Equal(aSizes, bSizes) {
+		d.OldPieceSize, d.NewPieceSize = aSizes, bSizes
+	}
+
+	if aTor != nil && bTor != nil {
+		aTrackers, bTrackers := trackers(*aTor), trackers(*bTor)
+		if !slices.Equal(aTrackers, bTrackers) {
+			d.OldTrackers, d.NewTrackers = aTrackers, bTrackers
+		}
+	}
+	return d
+}
+
+func pieceSizes(m Metalink) []int64 {
+	var sizes []int64
+	for _, mf := range m.Files {
+		for _, p := range mf.Pieces {
+			sizes = append(sizes, p.Length)
+		}
+		for _, p := range mf.ExternalPieces {
+			sizes = append(sizes, p.Length)
+		}
+	}
+	slices.Sort(sizes)
+	return slices.Compact(sizes)
+}
+
+// trackers lists the announce URLs of t in tier order
+func trackers(t Torrent) []string {
+	if len(t.AnnounceList) == 0 {
+		if t.Announce == "" {
+			return nil
+		}
+		return []string{t.Announce}
+	}
+	var list []string
+	for _, tier := range t.AnnounceList {
+		list = append(list, tier...)
+	}
+	return list
+}
+
+// MetalinkTorrent loads the torrent referenced by the metaurl of a metalink
+// read from metaPath, whether embedded or a file next to it. It returns nil
+// when there is none.
+func MetalinkTorrent(meta Metalink, metaPath string) (*Torrent, error) {
+	for _, mu := range meta.Metaurls {
+		if mu.MediaType != "application/x-bittorrent" && mu.MediaType != "torrent" {
+			continue
+		}
+		var tor Torrent
+		if data, ok := strings.CutPrefix(mu.Value, "data:application/x-bittorrent;base64,"); ok {
+			raw, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return nil, err
+			}
+			tor, err = UnmarshalTorrent(raw)
+			if err != nil {
+				return nil, err
+			}
+			return &tor, nil
+		}
+		if strings.Contains(mu.Value, "://") {
+			continue
+		}
+		p := filepath.Join(filepath.Dir(metaPath), filepath.FromSlash(mu.Value))
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		tor, err := ReadTorrentFile(p)
+		if err != nil {
+			return nil, err
+		}
+		return &tor, nil
+	}
+	return nil, nil
+}
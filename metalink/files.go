@@ -0,0 +1,198 @@
+package metalink
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func WriteTorrentFile(path string, t Torrent) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := bencode.Marshal(f, t.encoded()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MarshalTorrent returns the bencoded torrent
+func MarshalTorrent(t Torrent) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, t.encoded()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalTorrent parses a bencoded torrent
+func UnmarshalTorrent(data []byte) (Torrent, error) {
+	var t Torrent
+	err := bencode.Unmarshal(bytes.NewReader(data), &t)
+	return t, err
+}
+
+func ReadTorrentFile(path string) (Torrent, error) {
+	var t Torrent
+	f, err := os.Open(path)
+	if err != nil {
+		return t, err
+	}
+	defer f.Close()
+	err = bencode.Unmarshal(f, &t)
+	return t, err
+}
+
+func ReadMetaFile(path string) (Metalink, error) {
+	var m Metalink
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = xml.Unmarshal(b, &m)
+	return m, err
+}
+
+func WriteMetaFile(path string, m Metalink) error {
+	out, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append([]byte(xml.Header), out...)
+	return os.WriteFile(path, out, 0o644)
+}
+
+// WriteErrorsFile lists the failed results as "relpath<TAB>error" lines
+func WriteErrorsFile(path string, failed []FileHashResult) error {
+	var b strings.Builder
+	for _, r := range failed {
+		// Keep one line per file even if the message has a newline
+		msg := strings.ReplaceAll(r.Err.Error(), "\n", " ")
+		fmt.Fprintf(&b, "%s\t%s\n", r.RelPath, msg)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// WriteTorrentDump writes a human-readable summary of the torrent at
+// torrentPath, as parsed back from disk, for debugging
+func WriteTorrentDump(path string, torrentPath string) error {
+	t, err := ReadTorrentFile(torrentPath)
+	if err != nil {
+		return err
+	}
+	ih, err := InfoHash(t.Info)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "name:          %s\n", t.Info.Name)
+	fmt.Fprintf(&b, "infohash:      %x\n", ih)
+	fmt.Fprintf(&b, "announce:      %s\n", t.Announce)
+	for i, tier := range t.AnnounceList {
+		fmt.Fprintf(&b, "tier %d:        %s\n", i+1, strings.Join(tier, " "))
+	}
+	for _, u := range t.URLList {
+		fmt.Fprintf(&b, "url-list:      %s\n", u)
+	}
+	if t.CreationDate != 0 {
+		fmt.Fprintf(&b, "creation date: %s\n", time.Unix(t.CreationDate, 0).UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "piece length:  %d\n", t.Info.PieceLength)
+	if t.Info.RootHash != "" {
+		fmt.Fprintf(&b, "root hash:     %x\n", t.Info.RootHash)
+	} else {
+		fmt.Fprintf(&b, "pieces:        %d\n", len(t.Info.Pieces)/20)
+	}
+
+	if len(t.Info.Files) == 0 {
+		fmt.Fprintf(&b, "length:        %d\n", t.Info.Length)
+		if t.Info.Attr == "x" {
+			fmt.Fprintf(&b, "executable:    yes\n")
+		}
+	} else {
+		fmt.Fprintf(&b, "files:         %d\n", len(t.Info.Files))
+		for _, f := range t.Info.Files {
+			line := fmt.Sprintf("  %12d  %s", f.Length, strings.Join(f.Path, "/"))
+			switch f.Attr {
+			case "l":
+				line += " -> " + strings.Join(f.SymlinkPath, "/")
+			case "x":
+				line += " (executable)"
+			}
+			b.WriteString(line + "\n")
+		}
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// CheckGPG reports an actionable error when the gpg binary isn't on PATH
+func CheckGPG() error {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		return errors.New("gpg was not found in PATH; install GnuPG (e.g. the gnupg package) or drop --sign")
+	}
+	return nil
+}
+
+// PGPSignatureMediatype is the <signature> mediatype of PGPDetachedArmorSign
+// signatures
+const PGPSignatureMediatype = "application/pgp-signature"
+
+// GPGOptions point gpg at a keyring other than the user's default one, e.g.
+// an isolated one in CI
+type GPGOptions struct {
+	Homedir string // --homedir
+	Keyring string // used instead of the default public keyring
+}
+
+func PGPDetachedArmorSign(filePath string, keyname string) (string, error) {
+	return PGPDetachedArmorSignWith(filePath, keyname, GPGOptions{})
+}
+
+// CheckGPGKey reports an error when gpg has no secret key for keyname, so
+// that a missing key fails a run before hashing rather than after
+func CheckGPGKey(keyname string, opts GPGOptions) error {
+	args := append(opts.args(), "--batch", "--with-colons", "--list-secret-keys", "--", keyname)
+	out, err := exec.Command("gpg", args...).CombinedOutput()
+	if err != nil {
+		home := opts.Homedir
+		if home == "" {
+			home = "the default GnuPG home"
+		}
+		return fmt.Errorf("gpg has no secret key for %q in %s (check --sign and --gpg-home): %s", keyname, home, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (opts GPGOptions) args() []string {
+	var args []string
+	if opts.Homedir != "" {
+		args = append(args, "--homedir", opts.Homedir)
+	}
+	if opts.Keyring != "" {
+		args = append(args, "--no-default-keyring", "--keyring", opts.Keyring)
+	}
+	return args
+}
+
+// PGPDetachedArmorSignWith is PGPDetachedArmorSign with GPGOptions
+func PGPDetachedArmorSignWith(filePath string, keyname string, opts GPGOptions) (string, error) {
+	args := append(opts.args(), "--local-user", keyname, "--armor", "--detach-sign", "--output", "-", filePath)
+
+	cmd := exec.Command("gpg", args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("gpg failed: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
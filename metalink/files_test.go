@@ -0,0 +1,52 @@
+package metalink
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"testing"
+)
+
+// TestBencodeBinaryPieces round-trips piece hashes made of every byte value,
+// including NUL, high bytes and invalid UTF-8, through the bencoder. The
+// hashes are kept in a Go string, which must be written and read back byte
+// for byte rather than as text.
+func TestBencodeBinaryPieces(t *testing.T) {
+	var raw []byte
+	for i := range 256 {
+		raw = append(raw, byte(i))
+	}
+	// Lone continuation bytes, an overlong NUL and a truncated sequence
+	raw = append(raw, 0x80, 0xc0, 0x80, 0xe2, 0x82, 0, 0, 0xff, 0xfe)
+	raw = append(raw, make([]byte, sha1.Size-len(raw)%sha1.Size)...)
+
+	const pieceLength = 16 * 1024
+	tor := Torrent{Info: TorrentInfo{
+		Name:        "bin",
+		PieceLength: pieceLength,
+		Length:      int64(len(raw)/sha1.Size) * pieceLength,
+		Pieces:      string(raw),
+	}}
+	data, err := MarshalTorrent(tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A string is written as its length in bytes and the bytes themselves
+	if !bytes.Contains(data, append([]byte(fmt.Sprintf("6:pieces%d:", len(raw))), raw...)) {
+		t.Error("pieces are not written verbatim")
+	}
+	back, err := UnmarshalTorrent(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Info.Pieces != string(raw) {
+		t.Errorf("pieces changed in a round trip (%d bytes, expected %d)", len(back.Info.Pieces), len(raw))
+	}
+	again, err := MarshalTorrent(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Error("re-encoding the torrent changed it")
+	}
+}
@@ -0,0 +1,604 @@
+package metalink
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+type FileHashResult struct {
+	RelPath     string
+	Size        int64
+	FileSHA256  string   // hex encoded
+	PieceHashes []string // hex encoded SHA-256 piece hashes (per-file boundaries)
+	Err         error    `json:"-"`
+
+	SHA1PieceHashes []string `json:",omitempty"` // like PieceHashes, with Options.SHA1Pieces
+
+	ExtraPieces []ExtraPieceHashes `json:",omitempty"` // with Options.ExtraPieceSizes
+}
+
+// ExtraPieceHashes are hex encoded SHA-256 piece hashes of a file at another
+// piece length than the main one
+type ExtraPieceHashes struct {
+	Length int64
+	Hashes []string
+}
+
+// pieceList hashes the pieces of the current file at one extra piece length
+type pieceList struct {
+	length int64
+	sha256 hash.Hash
+	filled int64
+	hashes []string
+}
+
+func (pl *pieceList) write(data []byte) {
+	for len(data) > 0 {
+		n := min(int64(len(data)), pl.length-pl.filled)
+		pl.sha256.Write(data[:n])
+		pl.filled += n
+		data = data[n:]
+		if pl.filled == pl.length {
+			pl.end()
+		}
+	}
+}
+
+func (pl *pieceList) end() {
+	pl.hashes = append(pl.hashes, hex.EncodeToString(pl.sha256.Sum(nil)))
+	pl.sha256.Reset()
+	pl.filled = 0
+}
+
+type MultiHasher struct {
+	pieceSize int64
+
+	// SHA-1 for torrent (crosses file boundaries)
+	torrentPieceBuffer *bytes.Buffer
+	torrentPieceSHA1   hash.Hash
+	torrentPieces      *bytes.Buffer
+
+	// SHA-256 for current file
+	fileSHA256 hash.Hash
+
+	// SHA-256 for per-file pieces (resets at file boundaries)
+	filePieceSHA256      hash.Hash
+	filePieceBuffer      int64
+	currentFilePieceList []string
+
+	// Optional SHA-1 for per-file pieces, alongside the SHA-256 ones
+	filePieceSHA1            hash.Hash
+	currentFileSHA1PieceList []string
+
+	// Optional SHA-256 per-file pieces at other lengths
+	extraPieces []*pieceList
+
+	currentFileByteCount int64
+	currentFileRelPath   string
+
+	results []FileHashResult
+
+	// Torrent stream position at StartFile, so that a file that fails part
+	// way can be discarded. The partial piece is only copied once the file
+	// completes a piece and it would otherwise be lost.
+	rewindable      bool
+	startPieces     int
+	startPartialLen int
+	startPartial    []byte
+	partialSaved    bool
+
+	timings *Timings // Options.Timings
+
+	// Called by copyFrom at most once per tickEvery, for
+	// Options.ProgressInterval
+	tick      func()
+	tickEvery time.Duration
+	lastTick  time.Time
+
+	// Called by copyFrom at a piece boundary of the current file at most once
+	// per saveEvery, for Options.Checkpoint
+	save      func() error
+	saveEvery time.Duration
+	lastSave  time.Time
+}
+
+// Timings accumulates where HashFiles spends its time, to tell whether a run
+// is bound by the disk (or network) or by the CPU
+type Timings struct {
+	Read time.Duration // waiting for file and HTTP reads
+	Hash time.Duration // computing the hashes
+}
+
+func NewMultiHasher(pieceSize int64) *MultiHasher {
+	return &MultiHasher{
+		pieceSize:          pieceSize,
+		torrentPieceBuffer: new(bytes.Buffer),
+		torrentPieceSHA1:   sha1.New(),
+		torrentPieces:      new(bytes.Buffer),
+		fileSHA256:         sha256.New(),
+		filePieceSHA256:    sha256.New(),
+	}
+}
+
+func (mh *MultiHasher) StartFile(relPath string) {
+	mh.currentFileRelPath = relPath
+	mh.fileSHA256.Reset()
+	mh.filePieceSHA256.Reset()
+	mh.filePieceBuffer = 0
+	mh.currentFilePieceList = nil
+	if mh.filePieceSHA1 != nil {
+		mh.filePieceSHA1.Reset()
+		mh.currentFileSHA1PieceList = nil
+	}
+	mh.currentFileByteCount = 0
+	for _, pl := range mh.extraPieces {
+		pl.sha256.Reset()
+		pl.filled = 0
+		pl.hashes = nil
+	}
+
+	if mh.rewindable {
+		mh.startPieces = mh.torrentPieces.Len()
+		mh.startPartialLen = mh.torrentPieceBuffer.Len()
+		mh.partialSaved = false
+	}
+}
+
+// Write processes a chunk of data of the current file. It implements
+// io.Writer and never fails.
+func (mh *MultiHasher) Write(data []byte) (int, error) {
+	// Update file-level SHA-256
+	mh.fileSHA256.Write(data)
+	mh.currentFileByteCount += int64(len(data))
+	for _, pl := range mh.extraPieces {
+		pl.write(data)
+	}
+
+	offset := 0
+	for offset < len(data) {
+		// Process file-piece SHA-256 (resets at file boundaries)
+		spaceLeftFile := mh.pieceSize - mh.filePieceBuffer
+		toWriteFile := int64(len(data) - offset)
+		if toWriteFile > spaceLeftFile {
+			toWriteFile = spaceLeftFile
+		}
+
+		chunk := data[offset : offset+int(toWriteFile)]
+		mh.filePieceSHA256.Write(chunk)
+		if mh.filePieceSHA1 != nil {
+			mh.filePieceSHA1.Write(chunk)
+		}
+		mh.filePieceBuffer += toWriteFile
+
+		// Check if file piece is complete
+		if mh.filePieceBuffer == mh.pieceSize {
+			mh.endFilePiece()
+		}
+
+		offset += int(toWriteFile)
+	}
+
+	// Process torrent pieces (crosses file boundaries)
+	offset = 0
+	for offset < len(data) {
+		spaceLeftTorrent := mh.pieceSize - int64(mh.torrentPieceBuffer.Len())
+		toWriteTorrent := int64(len(data) - offset)
+		if toWriteTorrent > spaceLeftTorrent {
+			toWriteTorrent = spaceLeftTorrent
+		}
+
+		chunk := data[offset : offset+int(toWriteTorrent)]
+		mh.torrentPieceBuffer.Write(chunk)
+		mh.torrentPieceSHA1.Write(chunk)
+		offset += int(toWriteTorrent)
+
+		// Check if torrent piece is complete
+		if mh.torrentPieceBuffer.Len() == int(mh.pieceSize) {
+			if mh.rewindable && !mh.partialSaved {
+				mh.startPartial = append(mh.startPartial[:0], mh.torrentPieceBuffer.Bytes()[:mh.startPartialLen]...)
+				mh.partialSaved = true
+			}
+			sum := mh.torrentPieceSHA1.Sum(nil)
+			mh.torrentPieces.Write(sum)
+			mh.torrentPieceBuffer.Reset()
+			mh.torrentPieceSHA1.Reset()
+		}
+	}
+
+	return len(data), nil
+}
+
+// copyFrom feeds r to mh through buf, hiding any WriterTo (like *os.File's)
+// so that reads go through buf. Reads and writes are timed with Timings.
+func (mh *MultiHasher) copyFrom(r io.Reader, buf []byte) (int64, error) {
+	if mh.timings == nil && mh.tick == nil && mh.save == nil {
+		return io.CopyBuffer(mh, struct{ io.Reader }{r}, buf)
+	}
+	if buf == nil {
+		buf = make([]byte, 32*1024)
+	}
+	var n int64
+	for {
+		b := buf
+		due := mh.save != nil && time.Since(mh.lastSave) >= mh.saveEvery
+		if due && mh.filePieceBuffer > 0 {
+			// Stop at the end of the piece, where the checkpoint is taken
+			b = buf[:min(int64(len(buf)), mh.pieceSize-mh.filePieceBuffer)]
+		}
+		start := time.Now()
+		nr, err := r.Read(b)
+		if mh.timings != nil {
+			mh.timings.Read += time.Since(start)
+		}
+		if nr > 0 {
+			start = time.Now()
+			mh.Write(b[:nr])
+			if mh.timings != nil {
+				mh.timings.Hash += time.Since(start)
+			}
+			n += int64(nr)
+			if mh.tick != nil && time.Since(mh.lastTick) >= mh.tickEvery {
+				mh.lastTick = time.Now()
+				mh.tick()
+			}
+			if due && mh.filePieceBuffer == 0 {
+				mh.lastSave = time.Now()
+				if err := mh.save(); err != nil {
+					return n, err
+				}
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// HashReader hashes everything read from r as the file relPath, for example
+// an http.Response.Body. buf sets the read size; nil uses io.Copy's default.
+func (mh *MultiHasher) HashReader(relPath string, r io.Reader, buf []byte) (FileHashResult, error) {
+	mh.StartFile(relPath)
+	if _, err := mh.copyFrom(r, buf); err != nil {
+		return FileHashResult{}, err
+	}
+	return mh.EndFile(), nil
+}
+
+// endFilePiece records the hashes of the current per-file piece
+func (mh *MultiHasher) endFilePiece() {
+	mh.currentFilePieceList = append(mh.currentFilePieceList, hex.EncodeToString(mh.filePieceSHA256.Sum(nil)))
+	mh.filePieceSHA256.Reset()
+	if mh.filePieceSHA1 != nil {
+		mh.currentFileSHA1PieceList = append(mh.currentFileSHA1PieceList, hex.EncodeToString(mh.filePieceSHA1.Sum(nil)))
+		mh.filePieceSHA1.Reset()
+	}
+	mh.filePieceBuffer = 0
+}
+
+// EnableSHA1Pieces makes the hasher also compute per-file SHA-1 piece hashes,
+// reported in FileHashResult.SHA1PieceHashes. Call it before the first file.
+func (mh *MultiHasher) EnableSHA1Pieces() {
+	mh.filePieceSHA1 = sha1.New()
+}
+
+// EnableExtraPieceSizes makes the hasher also compute per-file SHA-256 piece
+// hashes at each of lengths, reported in FileHashResult.ExtraPieces in the
+// same order. Call it before the first file.
+func (mh *MultiHasher) EnableExtraPieceSizes(lengths []int64) {
+	for _, l := range lengths {
+		mh.extraPieces = append(mh.extraPieces, &pieceList{length: l, sha256: sha256.New()})
+	}
+}
+
+func (mh *MultiHasher) EndFile() FileHashResult {
+	// Finalize file-level SHA-256
+	fileSHA256Hex := hex.EncodeToString(mh.fileSHA256.Sum(nil))
+
+	// Finalize last partial file piece if any. A write that exactly fills a
+	// piece has already ended it and left filePieceBuffer at 0, so a size
+	// that is a multiple of the piece size gets no extra empty piece.
+	if mh.filePieceBuffer > 0 {
+		mh.endFilePiece()
+	}
+	var extra []ExtraPieceHashes
+	for _, pl := range mh.extraPieces {
+		if pl.filled > 0 {
+			pl.end()
+		}
+		extra = append(extra, ExtraPieceHashes{Length: pl.length, Hashes: pl.hashes})
+	}
+
+	result := FileHashResult{
+		RelPath:     mh.currentFileRelPath,
+		Size:        mh.currentFileByteCount,
+		FileSHA256:  fileSHA256Hex,
+		PieceHashes: mh.currentFilePieceList,
+		Err:         nil,
+
+		SHA1PieceHashes: mh.currentFileSHA1PieceList,
+		ExtraPieces:     extra,
+	}
+
+	mh.results = append(mh.results, result)
+	return result
+}
+
+// discard abandons the current file after err, rewinding the torrent stream
+// to where StartFile left it, and records a result carrying err. The hasher
+// must be rewindable.
+func (mh *MultiHasher) discard(err error) {
+	partial := mh.torrentPieceBuffer.Bytes()[:mh.startPartialLen]
+	if mh.partialSaved {
+		partial = mh.startPartial
+	}
+	partial = bytes.Clone(partial)
+
+	mh.torrentPieces.Truncate(mh.startPieces)
+	mh.torrentPieceBuffer.Reset()
+	mh.torrentPieceBuffer.Write(partial)
+	mh.torrentPieceSHA1.Reset()
+	mh.torrentPieceSHA1.Write(partial)
+
+	mh.results = append(mh.results, FileHashResult{RelPath: mh.currentFileRelPath, Err: err})
+}
+
+func (mh *MultiHasher) Finalize() {
+	// Finalize last torrent piece if partial
+	if mh.torrentPieceBuffer.Len() > 0 {
+		sum := mh.torrentPieceSHA1.Sum(nil)
+		mh.torrentPieces.Write(sum)
+	}
+}
+
+func (mh *MultiHasher) GetTorrentPieces() []byte {
+	return mh.torrentPieces.Bytes()
+}
+
+func (mh *MultiHasher) GetResults() []FileHashResult {
+	return mh.results
+}
+
+// checkpointInterval is how often Options.Checkpoint is saved, between files
+// or at piece boundaries inside one
+const checkpointInterval = 10 * time.Second
+
+// Checkpoint is the serializable state of a MultiHasher between files, or
+// part way through one. The partial torrent piece is stored as raw bytes and
+// re-fed on restore.
+type Checkpoint struct {
+	PieceSize     int64
+	Files         []FileInfo
+	Results       []FileHashResult
+	TorrentPieces []byte
+	PartialPiece  []byte
+	PartialLength int64             // bytes into the current torrent piece
+	Failed        map[string]string `json:",omitempty"` // error of each result that has one, by RelPath
+
+	// The hashes the results carry, which a resume must also compute
+	SHA1Pieces      bool    `json:",omitempty"`
+	ExtraPieceSizes []int64 `json:",omitempty"`
+
+	// Set when the checkpoint was taken inside Files[len(Results)]
+	Current *FileCheckpoint `json:",omitempty"`
+}
+
+// FileCheckpoint is the state of the file being hashed, taken at a boundary
+// of its pieces so that only the whole-file and extra piece hashes are
+// unfinished. Those are stored through encoding.BinaryMarshaler.
+type FileCheckpoint struct {
+	Offset          int64 // bytes of the file hashed so far
+	SHA256          []byte
+	PieceHashes     []string
+	SHA1PieceHashes []string          `json:",omitempty"`
+	ExtraPieces     []ExtraPieceState `json:",omitempty"`
+
+	// Torrent stream position when the file started, to discard it with
+	// KeepGoing
+	StartPieces  int
+	StartPartial []byte
+}
+
+// ExtraPieceState is the state of one extra piece length in a FileCheckpoint
+type ExtraPieceState struct {
+	Filled int64
+	SHA256 []byte
+	Hashes []string
+}
+
+// Checkpoint captures the hasher state. It must be called between EndFile
+// and the next StartFile, or from save to also capture the current file.
+func (mh *MultiHasher) Checkpoint(files []FileInfo) Checkpoint {
+	cp := Checkpoint{
+		PieceSize:     mh.pieceSize,
+		Files:         files,
+		Results:       mh.results,
+		TorrentPieces: mh.torrentPieces.Bytes(),
+		PartialPiece:  mh.torrentPieceBuffer.Bytes(),
+		PartialLength: int64(mh.torrentPieceBuffer.Len()),
+		SHA1Pieces:    mh.filePieceSHA1 != nil,
+	}
+	for _, pl := range mh.extraPieces {
+		cp.ExtraPieceSizes = append(cp.ExtraPieceSizes, pl.length)
+	}
+	for _, r := range mh.results {
+		if r.Err != nil {
+			if cp.Failed == nil {
+				cp.Failed = make(map[string]string)
+			}
+			cp.Failed[r.RelPath] = r.Err.Error()
+		}
+	}
+	return cp
+}
+
+// fileCheckpoint captures the state of the current file. It must be called
+// at a piece boundary of the file.
+func (mh *MultiHasher) fileCheckpoint() (*FileCheckpoint, error) {
+	if mh.filePieceBuffer != 0 {
+		return nil, errors.New("not at a piece boundary")
+	}
+	state, err := marshalHash(mh.fileSHA256)
+	if err != nil {
+		return nil, err
+	}
+	fc := &FileCheckpoint{
+		Offset:          mh.currentFileByteCount,
+		SHA256:          state,
+		PieceHashes:     mh.currentFilePieceList,
+		SHA1PieceHashes: mh.currentFileSHA1PieceList,
+	}
+	for _, pl := range mh.extraPieces {
+		state, err := marshalHash(pl.sha256)
+		if err != nil {
+			return nil, err
+		}
+		fc.ExtraPieces = append(fc.ExtraPieces, ExtraPieceState{Filled: pl.filled, SHA256: state, Hashes: pl.hashes})
+	}
+	if mh.rewindable {
+		fc.StartPieces = mh.startPieces
+		fc.StartPartial = mh.torrentPieceBuffer.Bytes()[:mh.startPartialLen]
+		if mh.partialSaved {
+			fc.StartPartial = mh.startPartial
+		}
+	}
+	return fc, nil
+}
+
+func marshalHash(h hash.Hash) ([]byte, error) {
+	m, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T state can't be saved", h)
+	}
+	return m.MarshalBinary()
+}
+
+func unmarshalHash(h hash.Hash, state []byte) error {
+	u, ok := h.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%T state can't be restored", h)
+	}
+	return u.UnmarshalBinary(state)
+}
+
+func (mh *MultiHasher) Restore(cp Checkpoint) error {
+	if cp.PieceSize != mh.pieceSize {
+		return fmt.Errorf("piece size %d does not match %d", cp.PieceSize, mh.pieceSize)
+	}
+	if cp.SHA1Pieces != (mh.filePieceSHA1 != nil) {
+		return fmt.Errorf("SHA-1 piece hashes %t do not match %t", cp.SHA1Pieces, mh.filePieceSHA1 != nil)
+	}
+	var extra []int64
+	for _, pl := range mh.extraPieces {
+		extra = append(extra, pl.length)
+	}
+	if !slices.Equal(cp.ExtraPieceSizes, extra) {
+		return fmt.Errorf("extra piece sizes %v do not match %v", cp.ExtraPieceSizes, extra)
+	}
+	if int64(len(cp.PartialPiece)) != cp.PartialLength || cp.PartialLength >= mh.pieceSize {
+		return errors.New("corrupt partial piece")
+	}
+	if len(cp.TorrentPieces)%sha1.Size != 0 {
+		return errors.New("corrupt torrent pieces")
+	}
+
+	mh.results = cp.Results
+	for i, r := range mh.results {
+		if msg, ok := cp.Failed[r.RelPath]; ok {
+			mh.results[i].Err = errors.New(msg)
+		}
+	}
+	mh.torrentPieces.Reset()
+	mh.torrentPieces.Write(cp.TorrentPieces)
+	mh.torrentPieceBuffer.Reset()
+	mh.torrentPieceBuffer.Write(cp.PartialPiece)
+	mh.torrentPieceSHA1.Reset()
+	mh.torrentPieceSHA1.Write(cp.PartialPiece)
+
+	if fc := cp.Current; fc != nil {
+		if len(cp.Results) >= len(cp.Files) {
+			return errors.New("current file is past the last file")
+		}
+		if fc.Offset <= 0 || fc.Offset%mh.pieceSize != 0 || len(fc.ExtraPieces) != len(mh.extraPieces) {
+			return errors.New("corrupt current file")
+		}
+		mh.StartFile(cp.Files[len(cp.Results)].RelPath)
+		if err := unmarshalHash(mh.fileSHA256, fc.SHA256); err != nil {
+			return err
+		}
+		mh.currentFileByteCount = fc.Offset
+		mh.currentFilePieceList = fc.PieceHashes
+		if mh.filePieceSHA1 != nil {
+			mh.currentFileSHA1PieceList = fc.SHA1PieceHashes
+		}
+		for i, pl := range mh.extraPieces {
+			if err := unmarshalHash(pl.sha256, fc.ExtraPieces[i].SHA256); err != nil {
+				return err
+			}
+			pl.filled, pl.hashes = fc.ExtraPieces[i].Filled, fc.ExtraPieces[i].Hashes
+		}
+		if mh.rewindable {
+			if fc.StartPieces > mh.torrentPieces.Len() || fc.StartPieces%sha1.Size != 0 || int64(len(fc.StartPartial)) >= mh.pieceSize {
+				return errors.New("corrupt current file")
+			}
+			mh.startPieces = fc.StartPieces
+			mh.startPartial = fc.StartPartial
+			mh.startPartialLen = len(fc.StartPartial)
+			mh.partialSaved = true
+		}
+	}
+	return nil
+}
+
+func readCheckpoint(path string) (*Checkpoint, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+func writeCheckpoint(path string, cp Checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	// Write-then-rename so an interrupted save never leaves a truncated checkpoint
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func sameFiles(a, b []FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
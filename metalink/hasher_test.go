@@ -0,0 +1,202 @@
+package metalink
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointMidFile(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "tree")
+	rng := rand.New(rand.NewSource(1))
+	sizes := map[string]int{"a.bin": 40_000, "b.bin": 300_000, "c.bin": 5}
+	data := make(map[string][]byte)
+	for name, n := range sizes {
+		data[name] = make([]byte, n)
+		rng.Read(data[name])
+		if err := os.MkdirAll(root, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), data[name], 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := Options{PieceSize: 16 * 1024, SHA1Pieces: true, ExtraPieceSizes: []int64{64 * 1024}, KeepGoing: true, NoSelfCheck: true}
+	tree, err := Walk(root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, wantPieces, err := HashFiles(tree, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop part way through the second file, at a piece boundary
+	mh, err := newHasher(opts.PieceSize, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := tree.Files[0]
+	mh.StartFile(first.RelPath)
+	mh.Write(data[first.RelPath])
+	mh.EndFile()
+	second := tree.Files[1]
+	mh.StartFile(second.RelPath)
+	mh.Write(data[second.RelPath][:3*opts.PieceSize])
+	cp := mh.Checkpoint(tree.Files)
+	if cp.Current, err = mh.fileCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "checkpoint")
+	if err := writeCheckpoint(path, cp); err != nil {
+		t.Fatal(err)
+	}
+
+	var resumed int64
+	resumeOpts := opts
+	resumeOpts.Checkpoint = path
+	resumeOpts.Resume = func(files int, bytes int64) { resumed = bytes }
+	got, gotPieces, err := HashFiles(tree, resumeOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantResumed := first.Size + 3*opts.PieceSize; resumed != wantResumed {
+		t.Errorf("resumed %d bytes, want %d", resumed, wantResumed)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed results differ:\n got %+v\nwant %+v", got, want)
+	}
+	if !bytes.Equal(gotPieces.Hashes, wantPieces.Hashes) {
+		t.Error("resumed torrent pieces differ")
+	}
+
+	// A resume must compute the same hashes as the checkpointed run
+	for _, change := range []func(*Options){
+		func(o *Options) { o.SHA1Pieces = false },
+		func(o *Options) { o.ExtraPieceSizes = nil },
+		func(o *Options) { o.ExtraPieceSizes = []int64{32 * 1024} },
+	} {
+		other := resumeOpts
+		change(&other)
+		if _, _, err := HashFiles(tree, other); err == nil || !strings.Contains(err.Error(), "restore checkpoint") {
+			t.Errorf("resume with different options: got %v, want a restore error", err)
+		}
+	}
+}
+
+// TestExactFill covers a file whose size is a multiple of the piece size,
+// written in piece-sized chunks so that the last write fills a piece exactly
+// at EOF. It must not produce an extra empty piece.
+func TestExactFill(t *testing.T) {
+	const pieceSize = 16
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3)
+
+	mh := NewMultiHasher(pieceSize)
+	mh.StartFile("exact")
+	for off := 0; off < len(data); off += pieceSize {
+		mh.Write(data[off : off+pieceSize])
+	}
+	r := mh.EndFile()
+	mh.Finalize()
+
+	if len(r.PieceHashes) != 3 {
+		t.Errorf("%d piece hashes, expected 3", len(r.PieceHashes))
+	}
+	if n := len(mh.GetTorrentPieces()) / sha1.Size; n != 3 {
+		t.Errorf("%d torrent pieces, expected 3", n)
+	}
+}
+
+// FuzzMultiHasher splits data into files and feeds them in random write
+// sizes, with tiny pieces so that writes straddle, fill and stop exactly at
+// piece and file boundaries, and compares every hash with hashing the same
+// bytes in one shot
+func FuzzMultiHasher(f *testing.F) {
+	f.Add([]byte("0123456789abcdef0123456789abcdef"), uint8(16), int64(0))
+	f.Add([]byte{}, uint8(1), int64(1))
+	f.Add(bytes.Repeat([]byte{0, 0xff}, 100), uint8(7), int64(2))
+	f.Fuzz(func(t *testing.T, data []byte, piece uint8, seed int64) {
+		pieceSize := int64(1 + piece%64)
+		rng := rand.New(rand.NewSource(seed))
+
+		// Cut data into up to 6 files, some of them empty
+		var files [][]byte
+		for rest := data; ; {
+			if len(files) == 5 {
+				files = append(files, rest)
+				break
+			}
+			n := rng.Intn(len(rest) + 1)
+			files = append(files, rest[:n])
+			rest = rest[n:]
+			if len(rest) == 0 && rng.Intn(2) == 0 {
+				break
+			}
+		}
+
+		mh := NewMultiHasher(pieceSize)
+		mh.EnableSHA1Pieces()
+		mh.EnableExtraPieceSizes([]int64{2 * pieceSize})
+		for i, file := range files {
+			mh.StartFile(fmt.Sprint(i))
+			for off := 0; off < len(file); {
+				n := min(1+rng.Intn(int(2*pieceSize)+1), len(file)-off)
+				mh.Write(file[off : off+n])
+				off += n
+			}
+			mh.EndFile()
+		}
+		mh.Finalize()
+
+		pieces := func(b []byte, size int64, sum func([]byte) []byte) []string {
+			var hashes []string
+			for off := int64(0); off < int64(len(b)); off += size {
+				hashes = append(hashes, hex.EncodeToString(sum(b[off:min(off+size, int64(len(b)))])))
+			}
+			return hashes
+		}
+		sum256 := func(b []byte) []byte { s := sha256.Sum256(b); return s[:] }
+		sum1 := func(b []byte) []byte { s := sha1.Sum(b); return s[:] }
+
+		results := mh.GetResults()
+		if len(results) != len(files) {
+			t.Fatalf("%d results for %d files", len(results), len(files))
+		}
+		for i, r := range results {
+			file := files[i]
+			if r.Size != int64(len(file)) || r.FileSHA256 != hex.EncodeToString(sum256(file)) {
+				t.Errorf("file %d has the wrong size or hash", i)
+			}
+			if !slices.Equal(r.PieceHashes, pieces(file, pieceSize, sum256)) {
+				t.Errorf("SHA-256 piece hashes of file %d (%d bytes) differ (piece size %d)", i, len(file), pieceSize)
+			}
+			if !slices.Equal(r.SHA1PieceHashes, pieces(file, pieceSize, sum1)) {
+				t.Errorf("SHA-1 piece hashes of file %d (%d bytes) differ (piece size %d)", i, len(file), pieceSize)
+			}
+			if len(r.ExtraPieces) != 1 || !slices.Equal(r.ExtraPieces[0].Hashes, pieces(file, 2*pieceSize, sum256)) {
+				t.Errorf("extra piece hashes of file %d (%d bytes) differ (piece size %d)", i, len(file), 2*pieceSize)
+			}
+		}
+
+		// Torrent pieces run across file boundaries, over the concatenation
+		var want []byte
+		for _, h := range pieces(data, pieceSize, sum1) {
+			b, _ := hex.DecodeString(h)
+			want = append(want, b...)
+		}
+		if !bytes.Equal(mh.GetTorrentPieces(), want) {
+			t.Errorf("torrent pieces differ (piece size %d)", pieceSize)
+		}
+	})
+}
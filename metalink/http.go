@@ -0,0 +1,126 @@
+package metalink
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RetryTransport retries GET and HEAD requests that fail with a network error
+// or a 429/5xx status, doubling the delay after each attempt. A response body
+// that fails part way through is not retried.
+type RetryTransport struct {
+	Base    http.RoundTripper
+	Retries int
+	Backoff time.Duration // delay before the first retry
+	Header  http.Header   // added to requests to the first host; see sameHost
+}
+
+func (rt *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := rt.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if len(rt.Header) > 0 && sameHost(req) {
+		req = req.Clone(req.Context())
+		for k, v := range rt.Header {
+			if k == "Host" {
+				req.Host = v[0]
+				continue
+			}
+			req.Header[k] = v
+		}
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return base.RoundTrip(req)
+	}
+
+	delay := rt.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := base.RoundTrip(req)
+		if attempt >= rt.Retries || !retryable(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// sameHost reports whether req is the first of a redirect chain or stays on
+// its host. Header may carry credentials or a Host override, which must not
+// follow a redirect to another server.
+func sameHost(req *http.Request) bool {
+	first := req
+	for first.Response != nil && first.Response.Request != nil {
+		first = first.Response.Request
+	}
+	return first.URL.Host == req.URL.Host
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// ParseHTTPHeaders parses "Key: Value" lines. Repeated keys keep all values.
+func ParseHTTPHeaders(lines []string) (http.Header, error) {
+	h := make(http.Header)
+	for _, line := range lines {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("header %q: expected 'Key: Value'", line)
+		}
+		k = strings.TrimSpace(k)
+		v = strings.TrimSpace(v)
+		if k == "" || strings.IndexFunc(k, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+			return nil, fmt.Errorf("header %q: invalid name %q", line, k)
+		}
+		if strings.ContainsAny(v, "\r\n\x00") {
+			return nil, fmt.Errorf("header %q: value contains a control character", line)
+		}
+		h.Add(k, v)
+	}
+	return h, nil
+}
+
+// isTokenChar reports whether r may appear in a header name (RFC 9110 tchar)
+func isTokenChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// NewHTTPClient returns a client for remote input that retries transient
+// failures and sends header with every request. timeout bounds connecting
+// and waiting for response headers but not reading the body, so large
+// downloads aren't cut off.
+func NewHTTPClient(retries int, timeout time.Duration, header http.Header) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if timeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = timeout
+		transport.ResponseHeaderTimeout = timeout
+	}
+	return &http.Client{
+		Transport: &RetryTransport{
+			Base:    transport,
+			Retries: retries,
+			Backoff: time.Second,
+			Header:  header,
+		},
+	}
+}
@@ -0,0 +1,53 @@
+package metalink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRetryTransportHeaderRedirect(t *testing.T) {
+	type seen struct{ auth, host string }
+	var got []seen
+	record := func(r *http.Request) {
+		got = append(got, seen{r.Header.Get("Authorization"), r.Host})
+	}
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		w.Write([]byte("ok"))
+	}))
+	defer other.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/away", http.StatusFound)
+		case "/away":
+			http.Redirect(w, r, other.URL+"/f", http.StatusFound)
+		}
+	}))
+	defer origin.Close()
+
+	header := http.Header{"Authorization": {"Bearer secret"}, "Host": {"files.example"}}
+	client := NewHTTPClient(0, 0, header)
+	resp, err := client.Get(origin.URL + "/same")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := []seen{
+		{"Bearer secret", "files.example"},
+		{"Bearer secret", "files.example"},
+		{"", other.Listener.Addr().String()},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d requests, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("request %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package metalink
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+// ignoreRule is a single gitignore-style pattern
+type ignoreRule struct {
+	segments []string // slash-separated pattern segments
+	negate   bool     // "!pattern" re-includes a previously excluded path
+	dirOnly  bool     // "pattern/" only matches directories
+	anchored bool     // a pattern containing a slash is matched from the root
+}
+
+// IgnoreMatcher applies gitignore-style rules to slash-separated relative
+// paths. As with git, the last matching rule wins and a file can't be
+// re-included once its parent directory is excluded.
+type IgnoreMatcher struct {
+	rules []ignoreRule
+}
+
+func LoadIgnoreFile(p string) (*IgnoreMatcher, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &IgnoreMatcher{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m.Add(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Add parses one line of an ignore file. Blank lines and comments are skipped.
+func (m *IgnoreMatcher) Add(line string) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return
+	}
+
+	rule.segments = strings.Split(line, "/")
+	m.rules = append(m.rules, rule)
+}
+
+// Match reports whether relPath is excluded
+func (m *IgnoreMatcher) Match(relPath string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	segments := strings.Split(relPath, "/")
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		var matched bool
+		if rule.anchored {
+			matched = matchSegments(rule.segments, segments)
+		} else {
+			matched = matchSegments(rule.segments, segments[len(segments)-1:])
+		}
+		if matched {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches path segments against pattern segments where "**"
+// matches zero or more whole segments
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(rest, segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
@@ -0,0 +1,161 @@
+package metalink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lfsMaxPointerSize is the size limit of Git LFS pointer files in the spec
+const lfsMaxPointerSize = 1024
+
+const lfsVersionLine = "version https://git-lfs.github.com/spec/v1"
+
+// LFSPointer is a Git LFS pointer file, which stands in for the real content
+// in a checkout where the object wasn't smudged
+type LFSPointer struct {
+	OID  string // hex SHA-256 of the content
+	Size int64
+}
+
+// LFSPointerFile is a pointer file found among the files of a tree
+type LFSPointerFile struct {
+	Index int // in Tree.Files
+	LFSPointer
+}
+
+// ParseLFSPointer recognizes the text of a Git LFS pointer file
+func ParseLFSPointer(data []byte) (LFSPointer, bool) {
+	var p LFSPointer
+	if len(data) >= lfsMaxPointerSize || !bytes.HasPrefix(data, []byte(lfsVersionLine+"\n")) {
+		return p, false
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		key, value, _ := strings.Cut(sc.Text(), " ")
+		switch key {
+		case "oid":
+			oid, ok := strings.CutPrefix(value, "sha256:")
+			if b, err := hex.DecodeString(oid); !ok || err != nil || len(b) != 32 {
+				return p, false
+			}
+			p.OID = oid
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return p, false
+			}
+			p.Size = size
+		}
+	}
+	return p, p.OID != ""
+}
+
+// FindLFSPointers returns the Git LFS pointer files of t, in the order of
+// t.Files. Only files small enough to be pointers are read.
+func FindLFSPointers(t Tree) ([]LFSPointerFile, error) {
+	var pointers []LFSPointerFile
+	buf := make([]byte, lfsMaxPointerSize)
+	for i, fi := range t.Files {
+		if fi.Size >= lfsMaxPointerSize || fi.Size < int64(len(lfsVersionLine)) || fi.URL != "" || fi.Placeholder || fi.Symlink != "" {
+			continue
+		}
+		f, _, err := t.open(fi)
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(f, buf[:fi.Size])
+		f.Close()
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%s: %w", fi.RelPath, err)
+		}
+		if p, ok := ParseLFSPointer(buf[:n]); ok {
+			pointers = append(pointers, LFSPointerFile{Index: i, LFSPointer: p})
+		}
+	}
+	return pointers, nil
+}
+
+// ResolveLFS makes each pointer file of t read from its object in the Git LFS
+// store of the repository containing t.Root, so that the real content is
+// packaged under the pointer's name. Check the hashes against the OIDs
+// afterwards, since the store isn't verified here.
+func ResolveLFS(t *Tree, pointers []LFSPointerFile) error {
+	if len(pointers) == 0 {
+		return nil
+	}
+	gitDir, err := findGitDir(t.Root)
+	if err != nil {
+		return err
+	}
+	objects := filepath.Join(gitDir, "lfs", "objects")
+	for _, p := range pointers {
+		fi := &t.Files[p.Index]
+		obj := filepath.Join(objects, p.OID[0:2], p.OID[2:4], p.OID)
+		info, err := os.Stat(obj)
+		if err != nil {
+			return fmt.Errorf("%s: LFS object %s is not in %s (try git lfs fetch): %w", fi.RelPath, p.OID, objects, err)
+		}
+		if info.Size() != p.Size {
+			return fmt.Errorf("%s: LFS object %s has %d bytes, the pointer says %d", fi.RelPath, p.OID, info.Size(), p.Size)
+		}
+		t.Total += p.Size - fi.Size
+		fi.Size = p.Size
+		fi.Source = obj
+	}
+	return nil
+}
+
+// findGitDir finds the Git directory of the repository containing path,
+// following the "gitdir:" file of worktrees and submodules to the common
+// directory, where LFS objects are kept
+func findGitDir(path string) (string, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	for {
+		candidate := filepath.Join(dir, ".git")
+		info, err := os.Stat(candidate)
+		if err == nil && info.IsDir() {
+			return candidate, nil
+		}
+		if err == nil {
+			return resolveGitFile(candidate)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("%s is not inside a Git repository", path)
+		}
+		dir = parent
+	}
+}
+
+func resolveGitFile(gitFile string) (string, error) {
+	data, err := os.ReadFile(gitFile)
+	if err != nil {
+		return "", err
+	}
+	gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+	if !ok {
+		return "", fmt.Errorf("%s has no gitdir line", gitFile)
+	}
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(gitFile), gitDir)
+	}
+	if common, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir := strings.TrimSpace(string(common))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+		return filepath.Clean(commonDir), nil
+	}
+	return gitDir, nil
+}
@@ -0,0 +1,80 @@
+package metalink
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// FileMapping publishes the local file Source under the slash-separated
+// Path
+type FileMapping struct {
+	Source string
+	Path   string
+}
+
+// MapTree is Walk for files gathered from anywhere on disk, each listed under
+// the path it is mapped to. The paths must be inside one top-level
+// directory, which names the tree as Walk would name it, or be a single file.
+// Exclude, MinFileSize and MaxFileSize don't apply: every mapping is packaged.
+func MapTree(mappings []FileMapping, opts Options) (Tree, error) {
+	var t Tree
+	if len(mappings) == 0 {
+		return t, errors.New("no files mapped")
+	}
+
+	// Every path, and every directory above one, to catch collisions
+	files := make(map[string]string)
+	dirs := make(map[string]string)
+	for _, m := range mappings {
+		name := path.Clean(m.Path)
+		if m.Path == "" || path.IsAbs(m.Path) || name == ".." || strings.HasPrefix(name, "../") || name != m.Path {
+			return t, fmt.Errorf("%s: mapped path must be relative and clean, like dir/file", m.Path)
+		}
+		if prev, ok := files[name]; ok {
+			return t, fmt.Errorf("%s and %s are both mapped to %s", prev, m.Source, name)
+		}
+		if prev, ok := dirs[name]; ok {
+			return t, fmt.Errorf("%s is mapped to %s, which is a directory of %s", m.Source, name, prev)
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if prev, ok := files[dir]; ok {
+				return t, fmt.Errorf("%s is mapped to %s, which makes a directory of the file %s", m.Source, name, prev)
+			}
+			dirs[dir] = name
+		}
+		files[name] = m.Source
+
+		info, err := os.Stat(m.Source)
+		if err != nil {
+			return t, err
+		}
+		if !info.Mode().IsRegular() {
+			return t, fmt.Errorf("%s is not a regular file", m.Source)
+		}
+		t.Files = append(t.Files, FileInfo{RelPath: name, Size: info.Size(), ModTime: info.ModTime().UnixNano(), Source: m.Source, Executable: opts.executable(info.Mode())})
+		t.Total += info.Size()
+		if err := opts.checkLimits(&t); err != nil {
+			return t, err
+		}
+	}
+
+	if len(t.Files) == 1 && !strings.Contains(t.Files[0].RelPath, "/") {
+		t.Root, t.Name = t.Files[0].Source, t.Files[0].RelPath
+		return t, nil
+	}
+	t.IsDir = true
+	for i, fi := range t.Files {
+		top, rel, _ := strings.Cut(fi.RelPath, "/")
+		if t.Name == "" {
+			t.Name = top
+		}
+		if top != t.Name || rel == "" {
+			return t, fmt.Errorf("%s is not inside %s/; map every file into one directory", fi.RelPath, t.Name)
+		}
+		t.Files[i].RelPath = rel
+	}
+	return t, nil
+}
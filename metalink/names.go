@@ -0,0 +1,98 @@
+package metalink
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// validName reports whether s is valid UTF-8 made only of characters XML
+// allows. encoding/xml would otherwise replace the rest with U+FFFD, so the
+// metalink would name a file that doesn't exist.
+func validName(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !xmlChar(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// xmlChar is the Char production of XML 1.0
+func xmlChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
+
+// sanitizeName replaces invalid UTF-8 and characters XML can't carry with
+// U+FFFD
+func sanitizeName(s string) string {
+	s = strings.ToValidUTF8(s, "�")
+	return strings.Map(func(r rune) rune {
+		if !xmlChar(r) {
+			return '�'
+		}
+		return r
+	}, s)
+}
+
+// CheckNames fails on the first file name (or symlink target) of t that
+// isn't valid UTF-8 or contains characters XML can't carry
+func CheckNames(t Tree) error {
+	if !validName(t.Name) {
+		return fmt.Errorf("%q is not valid UTF-8 text", t.Name)
+	}
+	for _, fi := range t.Files {
+		if !validName(fi.RelPath) {
+			return fmt.Errorf("%q is not valid UTF-8 text", fi.RelPath)
+		}
+		if !validName(fi.Symlink) {
+			return fmt.Errorf("symlink %s: target %q is not valid UTF-8 text", fi.RelPath, fi.Symlink)
+		}
+	}
+	return nil
+}
+
+// SanitizeNames replaces what CheckNames rejects with U+FFFD in the names of
+// t, and returns how many names were changed. Local files keep being read
+// from their original paths through FileInfo.Source. Names that collide
+// after the replacement are an error.
+func SanitizeNames(t *Tree) (int, error) {
+	if t.FS != nil {
+		return 0, errors.New("names can't be sanitized on a virtual filesystem")
+	}
+	// The root is read by its path as given, so only the name changes
+	renamed := 0
+	if !validName(t.Name) {
+		t.Name = sanitizeName(t.Name)
+		renamed++
+	}
+
+	seen := make(map[string]string, len(t.Files))
+	for i := range t.Files {
+		fi := &t.Files[i]
+		original := fi.RelPath
+		if !validName(fi.RelPath) {
+			if fi.Source == "" && fi.URL == "" && !fi.Placeholder {
+				fi.Source = t.FullPath(*fi)
+			}
+			fi.RelPath = sanitizeName(fi.RelPath)
+			renamed++
+		}
+		if !validName(fi.Symlink) {
+			fi.Symlink = sanitizeName(fi.Symlink)
+			renamed++
+		}
+		if other, ok := seen[fi.RelPath]; ok {
+			return renamed, fmt.Errorf("%q and %q are both %q once sanitized", other, original, fi.RelPath)
+		}
+		seen[fi.RelPath] = original
+	}
+	return renamed, nil
+}
@@ -0,0 +1,75 @@
+package metalink
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSanitizeNames packages a file whose name isn't valid UTF-8, which
+// CheckNames must refuse, and then renames it with SanitizeNames while still
+// reading it from its real path
+func TestSanitizeNames(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "names")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "bad\xff.bin"), []byte("content"), 0o644); err != nil {
+		t.Skipf("the filesystem only stores valid UTF-8: %v", err)
+	}
+
+	tree, err := Walk(root, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckNames(tree); err == nil {
+		t.Fatal("a name that isn't valid UTF-8 was accepted")
+	}
+	n, err := SanitizeNames(&tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(tree.Files) != 1 || tree.Files[0].RelPath != "bad�.bin" {
+		t.Fatalf("sanitized %d names to %v", n, tree.Files)
+	}
+	if err := CheckNames(tree); err != nil {
+		t.Errorf("sanitized names: %v", err)
+	}
+
+	results, _, err := HashFiles(tree, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256([]byte("content")); results[0].FileSHA256 != hex.EncodeToString(want[:]) {
+		t.Error("the sanitized file wasn't read from its real path")
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []FileInfo
+		ok    bool
+	}{
+		{"tree", []FileInfo{{RelPath: "dir/café.bin"}, {RelPath: "文档/说明.txt"}}, true},
+		{"tree\xff", []FileInfo{{RelPath: "a"}}, false},
+		{"tree", []FileInfo{{RelPath: "dir/\xc0\x80"}}, false},
+		{"tree", []FileInfo{{RelPath: "ctrl\x01"}}, false},
+		{"tree", []FileInfo{{RelPath: "link", Symlink: "bad\xfe"}}, false},
+	}
+	for _, tt := range tests {
+		err := CheckNames(Tree{Name: tt.name, Files: tt.files})
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckNames(%q, %v) = %v, want ok %t", tt.name, tt.files, err, tt.ok)
+		}
+	}
+}
+
+func TestSanitizeNamesCollision(t *testing.T) {
+	tree := Tree{Root: t.TempDir(), Name: "tree", IsDir: true, Files: []FileInfo{{RelPath: "a\xff"}, {RelPath: "a\xfe"}}}
+	if _, err := SanitizeNames(&tree); err == nil {
+		t.Error("names that collide once sanitized were accepted")
+	}
+}
@@ -0,0 +1,86 @@
+package metalink
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// PiecesFileMagic starts a pieces sidecar. The rest of the file is the raw
+// piece hashes of every file, concatenated in metalink order; the
+// ExternalPieces of each file says which ones are its own.
+const PiecesFileMagic = "mkmetalink-pieces/1\n"
+
+// ExternalizePieces moves the piece hashes of meta into a sidecar named href
+// and returns the sidecar's contents
+func ExternalizePieces(meta *Metalink, href string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(PiecesFileMagic)
+
+	for i := range meta.Files {
+		mf := &meta.Files[i]
+		for _, p := range mf.Pieces {
+			offset := int64(buf.Len() - len(PiecesFileMagic))
+			for _, h := range p.Hashes {
+				raw, err := hex.DecodeString(h.Value)
+				if err != nil || len(raw) != pieceHashSize(p.Type) {
+					return nil, fmt.Errorf("%s: invalid %s piece hash %q", mf.Name, p.Type, h.Value)
+				}
+				buf.Write(raw)
+			}
+			mf.ExternalPieces = append(mf.ExternalPieces, ExternalPieces{
+				Href:   href,
+				Type:   p.Type,
+				Length: p.Length,
+				Offset: offset,
+				Count:  len(p.Hashes),
+			})
+		}
+		mf.Pieces = nil
+	}
+	return buf.Bytes(), nil
+}
+
+// InlinePieces reverses ExternalizePieces given the sidecar's contents
+func InlinePieces(meta *Metalink, data []byte) error {
+	hashes, ok := bytes.CutPrefix(data, []byte(PiecesFileMagic))
+	if !ok {
+		return errors.New("not a pieces file")
+	}
+
+	for i := range meta.Files {
+		mf := &meta.Files[i]
+		for _, ext := range mf.ExternalPieces {
+			size := int64(pieceHashSize(ext.Type))
+			if size == 0 {
+				return fmt.Errorf("%s: unsupported piece hash type %s", mf.Name, ext.Type)
+			}
+			end := ext.Offset + int64(ext.Count)*size
+			if ext.Offset < 0 || ext.Count < 0 || end > int64(len(hashes)) {
+				return fmt.Errorf("%s: %s pieces at %d+%d are beyond the end of the pieces file", mf.Name, ext.Type, ext.Offset, ext.Count)
+			}
+
+			pieces := MetaPieces{Type: ext.Type, Length: ext.Length}
+			for pos := ext.Offset; pos < end; pos += size {
+				pieces.Hashes = append(pieces.Hashes, MetaPieceHash{
+					Type:  ext.Type,
+					Value: hex.EncodeToString(hashes[pos : pos+size]),
+				})
+			}
+			mf.Pieces = append(mf.Pieces, pieces)
+		}
+		mf.ExternalPieces = nil
+	}
+	return nil
+}
+
+func pieceHashSize(typ string) int {
+	switch typ {
+	case "sha-256":
+		return 32
+	case "sha-1":
+		return 20
+	}
+	return 0
+}
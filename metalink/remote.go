@@ -0,0 +1,171 @@
+package metalink
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// RemoteTree describes files to be fetched over HTTP(S). Several URLs are
+// packaged like a directory named after their common parent. Sizes come from
+// the Content-Length of a HEAD request, or of a GET of the first byte from
+// servers that refuse HEAD, and are -1 when the server doesn't report one;
+// HashFiles then fills them in from the stream. Modification times come from
+// Last-Modified.
+func RemoteTree(urls []string, client *http.Client) (Tree, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	t := Tree{IsDir: len(urls) > 1}
+	if len(urls) == 0 {
+		return t, fmt.Errorf("no URLs given")
+	}
+
+	seen := make(map[string]bool)
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return t, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return t, fmt.Errorf("%s: only http and https URLs are supported", raw)
+		}
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			return t, fmt.Errorf("%s: URL has no file name", raw)
+		}
+		if seen[name] {
+			return t, fmt.Errorf("%s: more than one URL is named %s", raw, name)
+		}
+		seen[name] = true
+
+		size, modTime, err := remoteStat(client, raw)
+		if err != nil {
+			return t, err
+		}
+		t.Files = append(t.Files, FileInfo{RelPath: name, Size: size, URL: raw, ModTime: modTime})
+		if size > 0 {
+			t.Total += size
+		}
+	}
+
+	t.Root = urls[0]
+	t.Name = t.Files[0].RelPath
+	if t.IsDir {
+		u, _ := url.Parse(urls[0])
+		t.Name = path.Base(path.Dir(u.Path))
+		if t.Name == "/" || t.Name == "." {
+			t.Name = u.Hostname()
+		}
+	}
+	return t, nil
+}
+
+// RemoteWebseeds returns the torrent url-list for a RemoteTree: the URL of a
+// single file, or the directory above the common parent of several files
+// (clients append the torrent name). It is empty when the files don't share
+// a parent directory.
+func RemoteWebseeds(t Tree) []string {
+	if !t.IsDir {
+		return []string{t.Files[0].URL}
+	}
+
+	var dir string
+	for i, fi := range t.Files {
+		u, err := url.Parse(fi.URL)
+		if err != nil {
+			return nil
+		}
+		u.Path = path.Dir(u.Path)
+		u.RawPath = ""
+		if i > 0 && u.String() != dir {
+			return nil
+		}
+		dir = u.String()
+	}
+
+	parent, ok := parentMirrorURL(dir, t.Name)
+	if !ok {
+		return nil
+	}
+	return []string{parent}
+}
+
+// remoteStat returns the size and modification time (Unix nanoseconds, 0 if
+// unknown) reported by a HEAD request
+func remoteStat(client *http.Client, u string) (int64, int64, error) {
+	resp, err := client.Head(u)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, lastModified(resp), nil
+	case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		// Some servers, and URLs presigned for GET only, refuse HEAD
+		return rangeStat(client, u)
+	}
+	return 0, 0, fmt.Errorf("HEAD %s: %s", u, resp.Status)
+}
+
+// rangeStat is remoteStat with a GET of the first byte. The size is -1 when
+// the response doesn't give it.
+func rangeStat(client *http.Client, u string) (int64, int64, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The range was ignored
+		return resp.ContentLength, lastModified(resp), nil
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// "bytes 0-0/SIZE", or "bytes */0" for an empty file
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		size, err := strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			size = -1
+		}
+		return size, lastModified(resp), nil
+	}
+	return 0, 0, fmt.Errorf("GET %s: %s", u, resp.Status)
+}
+
+func lastModified(resp *http.Response) int64 {
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		return t.UnixNano()
+	}
+	return 0
+}
+
+// hashURL streams u through mh and returns the bytes read. Redirects are
+// followed by the client.
+func hashURL(client *http.Client, mh *MultiHasher, u string, buf []byte) (int64, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	n, err := mh.copyFrom(resp.Body, buf)
+	if err != nil {
+		return n, fmt.Errorf("reading %s: %w", u, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,74 @@
+package metalink
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRemoteStat(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1000)
+	modTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "f.bin", modTime, bytes.NewReader(content))
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		wantSize int64
+		wantErr  bool
+	}{
+		{"head", serve, 1000, false},
+		{"head refused", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			serve(w, r)
+		}, 1000, false},
+		{"head forbidden, empty file", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.ServeContent(w, r, "f.bin", modTime, bytes.NewReader(nil))
+		}, 0, false},
+		{"head not implemented, range ignored", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotImplemented)
+				return
+			}
+			// Streamed without a Content-Length
+			w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+			w.Write(content)
+			w.(http.Flusher).Flush()
+		}, -1, false},
+		{"not found", http.NotFound, 0, true},
+		{"forbidden", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			size, mod, err := remoteStat(srv.Client(), srv.URL+"/f.bin")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("remoteStat: error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if size != tt.wantSize {
+				t.Errorf("size = %d, want %d", size, tt.wantSize)
+			}
+			if mod != modTime.UnixNano() {
+				t.Errorf("modification time = %d, want %d", mod, modTime.UnixNano())
+			}
+		})
+	}
+}
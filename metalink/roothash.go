@@ -0,0 +1,59 @@
+package metalink
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// RootHashType is the type attribute of <root-hash>
+const RootHashType = "merkle-sha-256"
+
+// RootHash is a single SHA-256 over the whole metalink, computed from its
+// <file> entries alone so that anyone holding the metalink can recompute it.
+// It is the RFC 6962 Merkle Tree Hash of one leaf per file, the leaves
+// ordered by file name bytewise, where each leaf is
+//
+//	name || 0x00 || SHA-256 of the file (32 raw bytes)
+//
+// That is, a leaf hashes to SHA-256(0x00 || leaf) and two subtrees to
+// SHA-256(0x01 || left || right), splitting n leaves at the largest power of
+// two below n. No files hash to SHA-256 of nothing.
+func RootHash(files []MetalinkFile) (string, error) {
+	leaves := make([][]byte, 0, len(files))
+	for _, mf := range files {
+		if mf.Hash.Type != "sha-256" {
+			return "", fmt.Errorf("%s has no sha-256 hash", mf.Name)
+		}
+		digest, err := hex.DecodeString(mf.Hash.Value)
+		if err != nil || len(digest) != sha256.Size {
+			return "", fmt.Errorf("%s: invalid sha-256 %q", mf.Name, mf.Hash.Value)
+		}
+		leaf := append([]byte(mf.Name), 0)
+		leaves = append(leaves, append(leaf, digest...))
+	}
+	// Names can't contain NUL, so this orders by name
+	slices.SortFunc(leaves, bytes.Compare)
+	return hex.EncodeToString(merkleTreeHash(leaves)), nil
+}
+
+func merkleTreeHash(leaves [][]byte) []byte {
+	h := sha256.New()
+	switch len(leaves) {
+	case 0:
+	case 1:
+		h.Write([]byte{0})
+		h.Write(leaves[0])
+	default:
+		k := 1
+		for k*2 < len(leaves) {
+			k *= 2
+		}
+		h.Write([]byte{1})
+		h.Write(merkleTreeHash(leaves[:k]))
+		h.Write(merkleTreeHash(leaves[k:]))
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,164 @@
+package metalink
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	P_MIN       = 256 * 1024
+	P_CAP       = 4 * 1024 * 1024
+	P_MAX       = 64 * 1024 * 1024
+	N_THRESHOLD = 7500
+	CHUNK_SIZE  = 32 * 1024 * 1024
+	P_FLOOR     = 16 * 1024 // smallest piece size clients accept
+)
+
+func CalculatePieceSize(total int64) int64 {
+	if total <= 0 {
+		return P_MIN
+	}
+
+	logExp := math.Floor(math.Log2(float64(total)) - 10)
+	baseLog := int64(math.Max(float64(P_MIN), math.Pow(2, logExp)))
+	current := baseLog
+	if current > P_CAP {
+		current = P_CAP
+	}
+
+	currentPieces := float64(total) / float64(current)
+	if currentPieces > N_THRESHOLD {
+		target := float64(total) / N_THRESHOLD
+		stepped := int64(math.Pow(2, math.Floor(math.Log2(target))))
+		if stepped < P_CAP {
+			stepped = P_CAP
+		}
+		if stepped > P_MAX {
+			stepped = P_MAX
+		}
+		current = stepped
+	}
+
+	if current < P_MIN {
+		current = P_MIN
+	}
+	return current
+}
+
+// FinerPieceSize halves pieceSize until total spans at least count pieces,
+// stopping at P_FLOOR
+func FinerPieceSize(total, pieceSize int64, count int) int64 {
+	for pieceSize > P_FLOOR && (total+pieceSize-1)/pieceSize < int64(count) {
+		pieceSize /= 2
+	}
+	return pieceSize
+}
+
+// PieceSpans reports how many files the torrent pieces span, on average and
+// at most. Empty files and symlinks occupy no bytes and span none.
+func PieceSpans(files []FileInfo, pieceSize int64) (avg float64, most int) {
+	var total int64
+	for _, fi := range files {
+		total += max(fi.Size, 0)
+	}
+	pieces := (total + pieceSize - 1) / pieceSize
+	if pieces == 0 {
+		return 0, 0
+	}
+
+	// Each file adds one to the pieces from its first to its last byte
+	delta := make([]int32, pieces+1)
+	var offset, touched int64
+	for _, fi := range files {
+		if fi.Size <= 0 {
+			continue
+		}
+		first, last := offset/pieceSize, (offset+fi.Size-1)/pieceSize
+		delta[first]++
+		delta[last+1]--
+		touched += last - first + 1
+		offset += fi.Size
+	}
+	var n int32
+	for _, d := range delta[:pieces] {
+		n += d
+		most = max(most, int(n))
+	}
+	return float64(touched) / float64(pieces), most
+}
+
+// FormatBytes renders b using IEC units when base is 1024 and SI units when
+// base is 1000
+func FormatBytes(b int64, base float64) string {
+	if b == 0 {
+		return "0 B"
+	}
+
+	// math.Log of a negative size is NaN, which can't index units
+	size, sign := float64(b), ""
+	if size < 0 {
+		size, sign = -size, "-"
+	}
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	if base == 1000 {
+		units = []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
+	}
+
+	i := math.Floor(math.Log(size) / math.Log(base))
+
+	// Bound the index
+	if i >= float64(len(units)) {
+		i = float64(len(units) - 1)
+	}
+
+	return fmt.Sprintf("%s%.1f %s", sign, size/math.Pow(base, i), units[int(i)])
+}
+
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kib": 1 << 10,
+	"kb":  1e3,
+	"m":   1 << 20,
+	"mib": 1 << 20,
+	"mb":  1e6,
+	"g":   1 << 30,
+	"gib": 1 << 30,
+	"gb":  1e9,
+	"t":   1 << 40,
+	"tib": 1 << 40,
+	"tb":  1e12,
+	"p":   1 << 50,
+	"pib": 1 << 50,
+	"pb":  1e15,
+	"e":   1 << 60,
+	"eib": 1 << 60,
+	"eb":  1e18,
+}
+
+// ParseSize is the inverse of FormatBytes. It accepts plain byte counts and
+// IEC (KiB, base 1024) or SI (KB, base 1000) suffixes, case-insensitively.
+// A bare K/M/G... is treated as IEC.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	num, unit := s, ""
+	if i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' }); i >= 0 {
+		num, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	mult, ok := sizeUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit %q", unit)
+	}
+	if n*mult >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return int64(n * mult), nil
+}
@@ -0,0 +1,61 @@
+package metalink
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"16KiB", 16 << 10, false},
+		{"16 kb", 16000, false},
+		{"1.5M", 3 << 19, false},
+		{"7EiB", 7 << 60, false},
+		{"9EB", 9_000_000_000_000_000_000, false},
+		{"8EiB", 0, true}, // 1<<63, one past math.MaxInt64
+		{"9.3EB", 0, true},
+		{"", 0, true},
+		{"12 parsecs", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSize(%q) error = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		b    int64
+		base float64
+		want string
+	}{
+		{0, 1024, "0 B"},
+		{1, 1024, "1.0 B"},
+		{1023, 1024, "1023.0 B"},
+		{1024, 1024, "1.0 KiB"},
+		{1000000, 1000, "1.0 MB"},
+		{1000000, 1024, "976.6 KiB"},
+		{16 << 30, 1024, "16.0 GiB"},
+		{math.MaxInt64, 1024, "8.0 EiB"},
+		{-1, 1024, "-1.0 B"},
+		{-1000000, 1000, "-1.0 MB"},
+		{math.MinInt64, 1024, "-8.0 EiB"},
+	}
+	for _, tt := range tests {
+		if got := FormatBytes(tt.b, tt.base); got != tt.want {
+			t.Errorf("FormatBytes(%d, %v) = %q, want %q", tt.b, tt.base, got, tt.want)
+		}
+	}
+}
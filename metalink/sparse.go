@@ -0,0 +1,83 @@
+package metalink
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// copySparse is copyFrom for a local file that may have holes: only the data
+// regions are read, and the hashers are fed zeros for the holes. That saves
+// the disk reads, not the hashing, which still has to see every byte. ok is
+// false, with nothing hashed, when the OS can't report holes. Reading starts
+// at from, the part of f that is already hashed.
+func (mh *MultiHasher) copySparse(f *os.File, from int64, buf []byte) (n int64, ok bool, err error) {
+	if !sparseSupported {
+		return 0, false, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size := info.Size()
+
+	for off := from; off < size; {
+		data, err := f.Seek(off, seekData)
+		switch {
+		case errors.Is(err, syscall.ENXIO):
+			// Only a hole is left
+			data = size
+		case err != nil && off == from:
+			return 0, false, nil
+		case err != nil:
+			return n, true, err
+		}
+		data = min(data, size)
+		if data > off {
+			mh.writeZeros(data-off, buf)
+			n += data - off
+		}
+		if data == size {
+			break
+		}
+
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return n, true, err
+		}
+		hole = min(hole, size)
+		if _, err := f.Seek(data, io.SeekStart); err != nil {
+			return n, true, err
+		}
+		m, err := mh.copyFrom(io.LimitReader(f, hole-data), buf)
+		n += m
+		if err != nil {
+			return n, true, err
+		}
+		if m < hole-data {
+			// Truncated while being read
+			return n, true, io.ErrUnexpectedEOF
+		}
+		off = hole
+	}
+	return n, true, nil
+}
+
+// writeZeros feeds n zero bytes to mh, using buf as the zero block
+func (mh *MultiHasher) writeZeros(n int64, buf []byte) {
+	clear(buf)
+	var start time.Time
+	if mh.timings != nil {
+		start = time.Now()
+	}
+	for n > 0 {
+		k := min(n, int64(len(buf)))
+		mh.Write(buf[:k])
+		n -= k
+	}
+	if mh.timings != nil {
+		mh.timings.Hash += time.Since(start)
+	}
+}
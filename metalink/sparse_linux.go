@@ -0,0 +1,9 @@
+package metalink
+
+// lseek whence values for finding the holes of sparse files
+const (
+	sparseSupported = true
+
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package metalink
+
+// Holes aren't looked for outside Linux, where the whence values differ
+const (
+	sparseSupported = false
+
+	seekData = 0
+	seekHole = 0
+)
@@ -0,0 +1,185 @@
+package metalink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// MetalinkWriter encodes a metalink one file at a time as hash results
+// arrive, so the piece hashes of a large tree are never all in memory. The
+// output is byte-for-byte what WriteMetaFile writes for BuildMetalink.
+type MetalinkWriter struct {
+	w   *bufio.Writer
+	enc *xml.Encoder
+
+	t           Tree
+	files       map[string]FileInfo
+	pieceLength int64
+	pieceTypes  []string
+	opts        MetalinkOptions
+	strict      *strictChecker // with MetalinkOptions.Strict
+
+	// With MetalinkOptions.RootHash, the names and hashes seen so far, and
+	// the root once closed
+	hashed   []MetalinkFile
+	rootHash string
+}
+
+// NewMetalinkWriter writes the document header to w. Pass WriteFile as
+// Options.OnResult and call Close once hashing is done.
+func NewMetalinkWriter(w io.Writer, t Tree, pieceLength int64, opts MetalinkOptions) (*MetalinkWriter, error) {
+	head, pieceTypes, err := metalinkHead(opts)
+	if err != nil {
+		return nil, err
+	}
+	warnFileMirrors(t, opts)
+
+	mw := &MetalinkWriter{
+		w:           bufio.NewWriter(w),
+		t:           t,
+		files:       make(map[string]FileInfo, len(t.Files)),
+		pieceLength: pieceLength,
+		pieceTypes:  pieceTypes,
+		opts:        opts,
+	}
+	for _, fi := range t.Files {
+		mw.files[fi.RelPath] = fi
+	}
+	if opts.Strict {
+		mw.strict = newStrictChecker()
+		if err := mw.strict.head(head); err != nil {
+			return nil, fmt.Errorf("strict: %w", err)
+		}
+	}
+	mw.enc = xml.NewEncoder(mw.w)
+	mw.enc.Indent("", "  ")
+
+	if _, err := mw.w.WriteString(xml.Header); err != nil {
+		return nil, err
+	}
+	start := xml.StartElement{
+		Name: xml.Name{Local: "metalink"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "xmlns"}, Value: head.XMLNs},
+			{Name: xml.Name{Local: "version"}, Value: head.Version},
+		},
+	}
+	if err := mw.enc.EncodeToken(start); err != nil {
+		return nil, err
+	}
+	if head.Published != "" {
+		if err := mw.enc.EncodeElement(head.Published, element("published")); err != nil {
+			return nil, err
+		}
+	}
+	for _, mu := range head.Metaurls {
+		if err := mw.enc.EncodeElement(mu, element("metaurl")); err != nil {
+			return nil, err
+		}
+	}
+	return mw, nil
+}
+
+// WriteFile encodes the <file> entry of r. Failed results and symlinks are
+// left out, as BuildMetalink leaves them out.
+func (mw *MetalinkWriter) WriteFile(r FileHashResult) error {
+	fi, ok := mw.files[r.RelPath]
+	if !ok {
+		return fmt.Errorf("%s is not in the tree", r.RelPath)
+	}
+	if r.Err != nil || fi.Symlink != "" {
+		return nil
+	}
+	mf, err := metalinkFile(mw.t, fi, r, mw.pieceLength, mw.pieceTypes, mw.opts)
+	if err != nil {
+		return err
+	}
+	if mw.strict != nil {
+		if err := mw.strict.file(mf); err != nil {
+			return fmt.Errorf("strict: %w", err)
+		}
+	}
+	if mw.opts.RootHash {
+		mw.hashed = append(mw.hashed, MetalinkFile{Name: mf.Name, Hash: mf.Hash})
+	}
+	return mw.enc.EncodeElement(mf, element("file"))
+}
+
+// Close ends the document and flushes it, without closing the underlying
+// writer
+func (mw *MetalinkWriter) Close() error {
+	if mw.strict != nil {
+		if err := mw.strict.end(); err != nil {
+			return fmt.Errorf("strict: %w", err)
+		}
+	}
+	if mw.opts.RootHash {
+		root, err := RootHash(mw.hashed)
+		if err != nil {
+			return fmt.Errorf("root hash: %w", err)
+		}
+		start := xml.StartElement{Name: xml.Name{Space: "https://github.com/chapmanjacobd/mkmetalink", Local: "root-hash"}}
+		if err := mw.enc.EncodeElement(MetaHash{Type: RootHashType, Value: root}, start); err != nil {
+			return err
+		}
+		mw.rootHash = root
+	}
+	if err := mw.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: "metalink"}}); err != nil {
+		return err
+	}
+	if err := mw.enc.Flush(); err != nil {
+		return err
+	}
+	return mw.w.Flush()
+}
+
+// RootHash is the <root-hash> written by Close, with MetalinkOptions.RootHash
+func (mw *MetalinkWriter) RootHash() string {
+	return mw.rootHash
+}
+
+func element(name string) xml.StartElement {
+	return xml.StartElement{Name: xml.Name{Local: name}}
+}
+
+// AppendSignature adds sig to the end of the metalink written by
+// WriteMetaFile or MetalinkWriter at path, without reading the rest of it
+func AppendSignature(path string, sig MetaSignature) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	end := []byte("</metalink>")
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := fi.Size() - int64(len(end))
+	tail := make([]byte, len(end))
+	if _, err := f.ReadAt(tail, offset); err != nil {
+		return err
+	}
+	if !bytes.Equal(tail, end) {
+		return errors.New("does not end with </metalink>")
+	}
+
+	// The end tag is on its own line, so the signature takes its place
+	var b bytes.Buffer
+	b.WriteString("  ")
+	if err := xml.NewEncoder(&b).EncodeElement(sig, element("signature")); err != nil {
+		return err
+	}
+	b.WriteString("\n")
+	b.Write(end)
+	if _, err := f.WriteAt(b.Bytes(), offset); err != nil {
+		return err
+	}
+	return f.Close()
+}
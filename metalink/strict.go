@@ -0,0 +1,141 @@
+package metalink
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// hashSizes are the IANA hash function textual names RFC 5854 refers to,
+// with their digest sizes in bytes
+var hashSizes = map[string]int{
+	"md5":     16,
+	"sha-1":   20,
+	"sha-224": 28,
+	"sha-256": 32,
+	"sha-384": 48,
+	"sha-512": 64,
+}
+
+// strictChecker enforces the RFC 5854 rules of MetalinkOptions.Strict. Files
+// are checked one at a time so that MetalinkWriter can use it too.
+type strictChecker struct {
+	names map[string]bool
+}
+
+func newStrictChecker() *strictChecker {
+	return &strictChecker{names: make(map[string]bool)}
+}
+
+func (sc *strictChecker) head(m Metalink) error {
+	if m.XMLNs != "urn:ietf:params:xml:ns:metalink" {
+		return fmt.Errorf("namespace %q is not urn:ietf:params:xml:ns:metalink", m.XMLNs)
+	}
+	if m.Published != "" {
+		if _, err := time.Parse(time.RFC3339, m.Published); err != nil {
+			return fmt.Errorf("published %q is not an RFC 3339 date", m.Published)
+		}
+	}
+	for _, mu := range m.Metaurls {
+		if mu.MediaType == "" {
+			return fmt.Errorf("metaurl %s has no mediatype", mu.Value)
+		}
+		if err := checkPriority(mu.Priority); err != nil {
+			return fmt.Errorf("metaurl %s: %w", mu.Value, err)
+		}
+		// The torrent is referenced relative to the metalink
+		if _, err := url.Parse(mu.Value); err != nil || mu.Value == "" {
+			return fmt.Errorf("metaurl %q is not a valid IRI reference", mu.Value)
+		}
+	}
+	return nil
+}
+
+func (sc *strictChecker) file(mf MetalinkFile) error {
+	if err := checkFileName(mf.Name); err != nil {
+		return err
+	}
+	if sc.names[mf.Name] {
+		return fmt.Errorf("%s is listed twice", mf.Name)
+	}
+	sc.names[mf.Name] = true
+
+	if mf.Size < 0 {
+		return fmt.Errorf("%s: negative size %d", mf.Name, mf.Size)
+	}
+	if err := checkHash(mf.Hash.Type, mf.Hash.Value); err != nil {
+		return fmt.Errorf("%s: %w", mf.Name, err)
+	}
+	for _, p := range mf.Pieces {
+		if p.Length <= 0 {
+			return fmt.Errorf("%s: %s piece length %d is not positive", mf.Name, p.Type, p.Length)
+		}
+		if want := (mf.Size + p.Length - 1) / p.Length; int64(len(p.Hashes)) != want {
+			return fmt.Errorf("%s: %d %s piece hashes for %d bytes, expected %d", mf.Name, len(p.Hashes), p.Type, mf.Size, want)
+		}
+		for _, h := range p.Hashes {
+			if err := checkHash(p.Type, h.Value); err != nil {
+				return fmt.Errorf("%s: piece %w", mf.Name, err)
+			}
+		}
+	}
+
+	if len(mf.URLs) == 0 {
+		return fmt.Errorf("%s has no url", mf.Name)
+	}
+	for _, u := range mf.URLs {
+		if err := checkPriority(u.Priority); err != nil {
+			return fmt.Errorf("%s: url %s: %w", mf.Name, u.Value, err)
+		}
+		parsed, err := url.Parse(u.Value)
+		if err != nil || parsed.Scheme == "" || (parsed.Host == "" && parsed.Opaque == "") {
+			return fmt.Errorf("%s: url %q is not an absolute IRI", mf.Name, u.Value)
+		}
+	}
+	return nil
+}
+
+func (sc *strictChecker) end() error {
+	if len(sc.names) == 0 {
+		return errors.New("no files")
+	}
+	return nil
+}
+
+// checkFileName applies the RFC 5854 section 4.1.2.1 restrictions on
+// relative paths
+func checkFileName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("file with an empty name")
+	case strings.HasPrefix(name, "/"), strings.HasPrefix(name, "./"), strings.HasPrefix(name, "../"),
+		strings.Contains(name, "/../"), strings.HasSuffix(name, "/.."), name == "..":
+		return fmt.Errorf("%s contains a directory traversal", name)
+	case strings.ContainsAny(name, "\\\x00"):
+		return fmt.Errorf("%s contains a backslash or NUL", name)
+	}
+	return nil
+}
+
+func checkHash(typ, value string) error {
+	size, ok := hashSizes[typ]
+	if !ok {
+		return fmt.Errorf("hash type %q is not an IANA hash name", typ)
+	}
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != size {
+		return fmt.Errorf("%s hash %q is not %d hex-encoded bytes", typ, value, size)
+	}
+	return nil
+}
+
+// checkPriority allows 0, which leaves the optional attribute out
+func checkPriority(p int) error {
+	if p < 0 || p > 999999 {
+		return fmt.Errorf("priority %d is outside 1-999999", p)
+	}
+	return nil
+}
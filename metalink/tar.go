@@ -0,0 +1,142 @@
+package metalink
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// HashTar is HashFiles for a tar stream, such as the output of `tar c dir`,
+// whose files are hashed in the order they come without touching the disk.
+// The entries must be inside one top-level directory, which names the tree
+// as Walk would name it. The size of the whole stream isn't known up front,
+// so opts.PieceSize must be set, and Progress reports no Total.
+//
+// Entries other than regular files are skipped, as are the paths that
+// opts.Exclude, MinFileSize and MaxFileSize leave out. A read error ends the
+// stream, so KeepGoing doesn't apply.
+func HashTar(r io.Reader, opts Options) (Tree, []FileHashResult, TorrentPieces, error) {
+	t := Tree{IsDir: true}
+	pieceSize := opts.PieceSize
+	if pieceSize < 16*1024 || pieceSize&(pieceSize-1) != 0 {
+		return t, nil, TorrentPieces{}, fmt.Errorf("piece size %d must be a power of two of at least 16 KiB", pieceSize)
+	}
+	readBuffer := opts.ReadBuffer
+	if readBuffer == 0 {
+		readBuffer = CHUNK_SIZE
+	}
+	if readBuffer < 0 {
+		return t, nil, TorrentPieces{}, errors.New("read buffer must be positive")
+	}
+	opts.KeepGoing = false
+	mh, err := newHasher(pieceSize, opts)
+	if err != nil {
+		return t, nil, TorrentPieces{}, err
+	}
+
+	startTime := time.Now()
+	mh.tickEvery, mh.lastTick = opts.ProgressInterval, startTime
+	buf := make([]byte, readBuffer)
+	seen := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return t, nil, TorrentPieces{}, fmt.Errorf("reading tar: %w", err)
+		}
+
+		name := strings.TrimPrefix(path.Clean(strings.TrimPrefix(hdr.Name, "./")), "/")
+		if name == "." {
+			continue
+		}
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return t, nil, TorrentPieces{}, fmt.Errorf("tar entry %s is outside the archive", hdr.Name)
+		}
+		top, rel, _ := strings.Cut(name, "/")
+		if t.Name == "" {
+			t.Name = top
+		}
+		if top != t.Name || (rel == "" && hdr.Typeflag != tar.TypeDir) {
+			return t, nil, TorrentPieces{}, fmt.Errorf("tar entry %s is not inside %s/; make the tar of a single directory, as with tar c DIR", hdr.Name, t.Name)
+		}
+		if rel == "" || hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			logf(opts.Logf, "skipping %s: not a regular file", rel)
+			continue
+		}
+		if tarExcluded(opts.Exclude, rel) || !opts.sizeAllowed(rel, hdr.Size) {
+			continue
+		}
+		if seen[rel] {
+			return t, nil, TorrentPieces{}, fmt.Errorf("tar entry %s appears twice", hdr.Name)
+		}
+		seen[rel] = true
+
+		fi := FileInfo{RelPath: rel, Size: hdr.Size, ModTime: hdr.ModTime.UnixNano(), Executable: opts.executable(fs.FileMode(hdr.Mode))}
+		t.Files = append(t.Files, fi)
+		t.Total += fi.Size
+		if err := opts.checkLimits(&t); err != nil {
+			return t, nil, TorrentPieces{}, err
+		}
+		mh.StartFile(rel)
+		if opts.Progress != nil && opts.ProgressInterval > 0 {
+			mh.tick = func() {
+				opts.Progress(Progress{
+					File:    fi,
+					Bytes:   t.Total - fi.Size + mh.currentFileByteCount,
+					Files:   len(t.Files) - 1,
+					Elapsed: time.Since(startTime),
+					Partial: true,
+				})
+			}
+		}
+		// The tar reader fails on a short entry
+		if _, err := mh.copyFrom(tr, buf); err != nil {
+			return t, nil, TorrentPieces{}, fmt.Errorf("reading %s from tar: %w", rel, err)
+		}
+		mh.EndFile()
+
+		if opts.Progress != nil {
+			opts.Progress(Progress{
+				File:    fi,
+				Bytes:   t.Total,
+				Files:   len(t.Files),
+				Elapsed: time.Since(startTime),
+			})
+		}
+	}
+	if len(t.Files) == 0 {
+		return t, nil, TorrentPieces{}, errors.New("no files found in the tar")
+	}
+
+	mh.Finalize()
+	results := mh.GetResults()
+	pieces := TorrentPieces{PieceLength: pieceSize, Hashes: mh.GetTorrentPieces()}
+	if !opts.NoSelfCheck {
+		if err := selfCheck(t.Files, results, pieces.Hashes, pieceSize, true); err != nil {
+			return t, nil, TorrentPieces{}, fmt.Errorf("self-check failed (this is a bug): %w", err)
+		}
+	}
+	return t, results, pieces, nil
+}
+
+// tarExcluded matches rel and its parent directories against m, as Walk
+// skips the whole of an excluded directory
+func tarExcluded(m *IgnoreMatcher, rel string) bool {
+	for i, r := range rel {
+		if r == '/' && m.Match(rel[:i], true) {
+			return true
+		}
+	}
+	return m.Match(rel, false)
+}
@@ -0,0 +1,811 @@
+package metalink
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+type FileInfo struct {
+	RelPath     string // always slash-separated, regardless of platform
+	Size        int64
+	Placeholder bool   // zero-byte stand-in for an empty directory; not on disk
+	URL         string `json:",omitempty"` // remote source, fetched instead of a local file
+	ModTime     int64  `json:",omitempty"` // Unix nanoseconds; 0 when unknown
+	Symlink     string `json:",omitempty"` // link target relative to the root; recorded in the torrent instead of hashed
+	Source      string `json:",omitempty"` // OS path the content is read from instead, e.g. a Git LFS object
+	Executable  bool   `json:",omitempty"` // with Options.PreserveMode; a BEP-47 "x" attribute in the torrent
+}
+
+// Tree is the set of files to package
+type Tree struct {
+	Root  string // path as given, a file or directory
+	Name  string // base name of Root; the torrent name and metalink prefix
+	IsDir bool
+	Files []FileInfo
+	Total int64
+
+	FS fs.FS // files are read from here by RelPath when set; see WalkFS
+}
+
+// FullPath returns the on-disk path of fi
+func (t Tree) FullPath(fi FileInfo) string {
+	if fi.Source != "" {
+		return fi.Source
+	}
+	if !t.IsDir {
+		return t.Root
+	}
+	return filepath.Join(t.Root, filepath.FromSlash(fi.RelPath))
+}
+
+// TorrentPieces are the concatenated SHA-1 piece hashes of the torrent
+// stream, which crosses file boundaries
+type TorrentPieces struct {
+	PieceLength int64
+	Hashes      []byte
+}
+
+// Progress is reported after each file is hashed, and with
+// Options.ProgressInterval also part way through one
+type Progress struct {
+	File    FileInfo
+	Bytes   int64 // bytes finished so far, including resumed ones
+	Files   int   // files finished so far, including resumed and failed ones
+	Count   int   // files in all; 0 when unknown, as for HashTar
+	Resumed int64 // bytes restored from a checkpoint rather than hashed
+	Total   int64
+	Elapsed time.Duration
+	Err     error // the file was skipped with Options.KeepGoing
+	Partial bool  // File is still being read; Bytes includes what was read of it
+}
+
+type Options struct {
+	// Walk
+	Exclude             *IgnoreMatcher
+	EmptyDirPlaceholder string
+	RecordSymlinks      bool  // list symlinks to files inside the root as BEP-47 symlinks
+	PreserveMode        bool  // mark files with an execute bit as FileInfo.Executable
+	MinFileSize         int64 // skip smaller files
+	MaxFileSize         int64 // skip larger files; 0 is no limit
+
+	// Stop the walk with ErrTooManyFiles or ErrTooLarge past these, e.g.
+	// when pointed at / by mistake; 0 is no limit
+	MaxFiles     int
+	MaxTotalSize int64
+
+	// Files and directories to leave out wherever they are, such as the
+	// tool's own output from a previous run
+	ExcludePaths []string
+
+	// Hashing
+	PieceSize   int64 // 0 picks one with CalculatePieceSize
+	ReadBuffer  int64 // 0 uses CHUNK_SIZE
+	Checkpoint  string
+	NoSelfCheck bool
+	HTTPClient  *http.Client // for remote files; nil uses http.DefaultClient
+	KeepGoing   bool         // record read errors in FileHashResult.Err instead of failing; see DropFailed
+	SHA1Pieces  bool         // also compute per-file SHA-1 piece hashes
+	SparseAware bool         // read only the data regions of sparse local files, on Linux
+
+	// Also compute per-file SHA-256 piece hashes at these lengths, for
+	// clients that verify coarsely first. Powers of two of at least 16 KiB.
+	ExtraPieceSizes []int64
+
+	Progress func(Progress)
+	Resume   func(files int, bytes int64)
+
+	// Also report Progress while reading a file, at most this often, for
+	// files that take minutes each. 0 reports after each file only.
+	ProgressInterval time.Duration
+
+	// Receives each file's result as soon as it is hashed, e.g.
+	// MetalinkWriter.WriteFile. The returned results then carry no piece
+	// hashes, which keeps memory flat for huge trees. Can't be combined with
+	// Checkpoint.
+	OnResult func(FileHashResult) error
+
+	Timings *Timings // if set, read and hash times are added to it
+
+	// Receives warnings and the files the walk skips, e.g. log.Printf; nil
+	// discards them
+	Logf func(format string, args ...any)
+}
+
+// Walk errors for Options.MaxFiles and Options.MaxTotalSize
+var (
+	ErrTooManyFiles = errors.New("too many files")
+	ErrTooLarge     = errors.New("too large")
+)
+
+// Walk lists the regular files under root in lexical order. A file root is
+// packaged on its own.
+func Walk(root string, opts Options) (Tree, error) {
+	t := Tree{Root: root, Name: filepath.Base(root)}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return t, err
+	}
+	t.IsDir = info.IsDir()
+
+	if !t.IsDir {
+		if !opts.sizeAllowed(t.Name, info.Size()) {
+			return t, nil
+		}
+		if opts.MaxTotalSize > 0 && info.Size() > opts.MaxTotalSize {
+			return t, fmt.Errorf("%w: %s is over %s", ErrTooLarge, FormatBytes(info.Size(), 1024), FormatBytes(opts.MaxTotalSize, 1024))
+		}
+		t.Files = []FileInfo{{RelPath: t.Name, Size: info.Size(), ModTime: info.ModTime().UnixNano(), Executable: opts.executable(info.Mode())}}
+		t.Total = info.Size()
+		return t, nil
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return t, err
+	}
+	if err := t.walkDir(os.DirFS(root), absRoot, opts); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// WalkFS lists the regular files of fsys like Walk lists a directory, for
+// virtual filesystems such as embed.FS, zip.Reader or fstest.MapFS. name is
+// the torrent name and metalink prefix. HashFiles reads the files from fsys.
+// ExcludePaths, being OS paths, don't apply, and only relative symlinks can
+// be recorded.
+func WalkFS(fsys fs.FS, name string, opts Options) (Tree, error) {
+	t := Tree{Root: name, Name: name, IsDir: true, FS: fsys}
+	if err := t.walkDir(fsys, "", opts); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// walkDir adds the files of fsys to t. absRoot is the OS path of fsys, or
+// empty for a virtual filesystem.
+func (t *Tree) walkDir(fsys fs.FS, absRoot string, opts Options) error {
+	excluded := make(map[string]bool)
+	if absRoot != "" {
+		for _, p := range opts.ExcludePaths {
+			if abs, err := filepath.Abs(p); err == nil {
+				excluded[abs] = true
+			}
+		}
+	}
+
+	var dirs []string
+	err := fs.WalkDir(fsys, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel != "." && opts.Exclude.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			if excluded[filepath.Join(absRoot, filepath.FromSlash(rel))] {
+				logf(opts.Logf, "skipping %s/: output of a previous run", rel)
+				return fs.SkipDir
+			}
+			dirs = append(dirs, rel)
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 && opts.RecordSymlinks {
+			target, err := symlinkTarget(fsys, absRoot, rel)
+			if err != nil {
+				logf(opts.Logf, "warning: not recording symlink %s: %v", rel, err)
+				return nil
+			}
+			t.Files = append(t.Files, FileInfo{RelPath: rel, Symlink: target, ModTime: fi.ModTime().UnixNano()})
+			return opts.checkLimits(t)
+		}
+		if !fi.Mode().IsRegular() || !opts.sizeAllowed(rel, fi.Size()) {
+			return nil
+		}
+		if excluded[filepath.Join(absRoot, filepath.FromSlash(rel))] {
+			logf(opts.Logf, "skipping %s: output of a previous run", rel)
+			return nil
+		}
+		t.Files = append(t.Files, FileInfo{RelPath: rel, Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Executable: opts.executable(fi.Mode())})
+		t.Total += fi.Size()
+		return opts.checkLimits(t)
+	})
+	if err != nil {
+		return fmt.Errorf("walk: %w", err)
+	}
+
+	if opts.EmptyDirPlaceholder != "" {
+		name := opts.EmptyDirPlaceholder
+		if strings.Contains(name, "/") || name == "." || name == ".." {
+			return fmt.Errorf("empty-dir-placeholder %q must be a plain file name", name)
+		}
+		t.Files = addEmptyDirPlaceholders(t.Files, dirs, name)
+	}
+	return nil
+}
+
+// logf prints a warning through the Logf of some options, if set
+func logf(f func(format string, args ...any), format string, args ...any) {
+	if f != nil {
+		f(format, args...)
+	}
+}
+
+// checkLimits stops the walk as soon as t exceeds MaxFiles or MaxTotalSize
+func (opts Options) checkLimits(t *Tree) error {
+	if opts.MaxFiles > 0 && len(t.Files) > opts.MaxFiles {
+		return fmt.Errorf("%w: more than %d", ErrTooManyFiles, opts.MaxFiles)
+	}
+	if opts.MaxTotalSize > 0 && t.Total > opts.MaxTotalSize {
+		return fmt.Errorf("%w: more than %s", ErrTooLarge, FormatBytes(opts.MaxTotalSize, 1024))
+	}
+	return nil
+}
+
+// executable applies PreserveMode to a file's mode
+func (opts Options) executable(mode fs.FileMode) bool {
+	return opts.PreserveMode && mode&0o111 != 0
+}
+
+// sizeAllowed applies MinFileSize and MaxFileSize, logging skipped files
+func (opts Options) sizeAllowed(relPath string, size int64) bool {
+	switch {
+	case size < opts.MinFileSize:
+		logf(opts.Logf, "skipping %s: %s is below the minimum file size", relPath, FormatBytes(size, 1024))
+		return false
+	case opts.MaxFileSize > 0 && size > opts.MaxFileSize:
+		logf(opts.Logf, "skipping %s: %s is above the maximum file size", relPath, FormatBytes(size, 1024))
+		return false
+	}
+	return true
+}
+
+// symlinkTarget returns the slash-separated target of the symlink rel in
+// fsys relative to its root. Targets outside the root can't be represented,
+// nor can absolute ones without the OS path of the root.
+func symlinkTarget(fsys fs.FS, absRoot, rel string) (string, error) {
+	target, err := fs.ReadLink(fsys, rel)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(target) {
+		if absRoot == "" {
+			return "", errors.New("absolute target")
+		}
+		target, err = filepath.Rel(absRoot, target)
+		if err != nil {
+			return "", err
+		}
+		target = filepath.ToSlash(target)
+	} else {
+		target = path.Join(path.Dir(rel), filepath.ToSlash(target))
+	}
+	if target == "." || target == ".." || strings.HasPrefix(target, "../") {
+		return "", errors.New("target is outside the directory")
+	}
+	return target, nil
+}
+
+// addEmptyDirPlaceholders adds a placeholder entry for each directory that
+// contains no packaged files or subdirectories, keeping walk order
+func addEmptyDirPlaceholders(files []FileInfo, dirs []string, name string) []FileInfo {
+	nonEmpty := make(map[string]bool)
+	markParents := func(p string) {
+		for d := path.Dir(p); d != "." && !nonEmpty[d]; d = path.Dir(d) {
+			nonEmpty[d] = true
+		}
+	}
+	for _, fi := range files {
+		markParents(fi.RelPath)
+	}
+	for _, d := range dirs {
+		markParents(d)
+	}
+
+	for _, d := range dirs {
+		if !nonEmpty[d] {
+			files = append(files, FileInfo{RelPath: d + "/" + name, Placeholder: true})
+		}
+	}
+
+	slices.SortStableFunc(files, compareNames)
+	return files
+}
+
+// compareNames orders like filepath.Walk, which visits entries in lexical
+// order within each directory: a segment-by-segment comparison of the paths
+func compareNames(a, b FileInfo) int {
+	return slices.Compare(strings.Split(a.RelPath, "/"), strings.Split(b.RelPath, "/"))
+}
+
+// SortFiles orders t.Files by "name" (walk order), "size" (largest first) or
+// "mtime" (newest first). Ties keep name order. Both artifacts list files in
+// this order, and it determines the torrent's piece layout.
+func SortFiles(t *Tree, by string) error {
+	var cmp func(a, b FileInfo) int
+	switch by {
+	case "", "name":
+		cmp = compareNames
+	case "size":
+		cmp = func(a, b FileInfo) int {
+			if c := -cmpInt(a.Size, b.Size); c != 0 {
+				return c
+			}
+			return compareNames(a, b)
+		}
+	case "mtime":
+		cmp = func(a, b FileInfo) int {
+			if c := -cmpInt(a.ModTime, b.ModTime); c != 0 {
+				return c
+			}
+			return compareNames(a, b)
+		}
+	default:
+		return fmt.Errorf("unknown sort order %q", by)
+	}
+	slices.SortStableFunc(t.Files, cmp)
+	return nil
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// SelfCheck verifies that the number of piece hashes agrees with the file
+// sizes, for both the per-file SHA-256 pieces and the torrent SHA-1 stream
+func SelfCheck(files []FileInfo, results []FileHashResult, torrentPieces []byte, pieceSize int64) error {
+	return selfCheck(files, results, torrentPieces, pieceSize, true)
+}
+
+// selfCheck is SelfCheck, optionally without the per-file piece counts for
+// results whose pieces were handed to Options.OnResult and dropped
+func selfCheck(files []FileInfo, results []FileHashResult, torrentPieces []byte, pieceSize int64, perFile bool) error {
+	if len(results) != len(files) {
+		return fmt.Errorf("hashed %d files, expected %d", len(results), len(files))
+	}
+
+	var total int64
+	for i, r := range results {
+		if r.RelPath != files[i].RelPath {
+			return fmt.Errorf("result %d is %s, expected %s", i, r.RelPath, files[i].RelPath)
+		}
+		if r.Size != files[i].Size {
+			return fmt.Errorf("%s: hashed %d bytes, expected %d", r.RelPath, r.Size, files[i].Size)
+		}
+		if perFile {
+			if err := checkPieceCount(r, pieceSize); err != nil {
+				return err
+			}
+		}
+		total += r.Size
+	}
+
+	if len(torrentPieces)%sha1.Size != 0 {
+		return fmt.Errorf("torrent pieces length %d is not a multiple of %d", len(torrentPieces), sha1.Size)
+	}
+	want := (total + pieceSize - 1) / pieceSize
+	if got := int64(len(torrentPieces) / sha1.Size); got != want {
+		return fmt.Errorf("%d torrent pieces, expected %d", got, want)
+	}
+	return nil
+}
+
+func checkPieceCount(r FileHashResult, pieceSize int64) error {
+	// An empty file has no pieces
+	want := (r.Size + pieceSize - 1) / pieceSize
+	if int64(len(r.PieceHashes)) != want {
+		return fmt.Errorf("%s: %d piece hashes, expected %d", r.RelPath, len(r.PieceHashes), want)
+	}
+	if r.SHA1PieceHashes != nil && int64(len(r.SHA1PieceHashes)) != want {
+		return fmt.Errorf("%s: %d SHA-1 piece hashes, expected %d", r.RelPath, len(r.SHA1PieceHashes), want)
+	}
+	return nil
+}
+
+// DropFailed removes the files that HashFiles couldn't read with
+// Options.KeepGoing from t, and splits results into the hashed and failed ones
+func DropFailed(t *Tree, results []FileHashResult) (ok, failed []FileHashResult) {
+	bad := make(map[string]bool)
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+			bad[r.RelPath] = true
+		} else {
+			ok = append(ok, r)
+		}
+	}
+	if len(failed) == 0 {
+		return ok, nil
+	}
+
+	files := make([]FileInfo, 0, len(t.Files)-len(failed))
+	t.Total = 0
+	for _, fi := range t.Files {
+		if !bad[fi.RelPath] {
+			files = append(files, fi)
+			t.Total += max(fi.Size, 0)
+		}
+	}
+	t.Files = files
+	return ok, failed
+}
+
+// HashTree walks root and hashes every file in a single pass
+func HashTree(root string, opts Options) ([]FileHashResult, TorrentPieces, error) {
+	t, err := Walk(root, opts)
+	if err != nil {
+		return nil, TorrentPieces{}, err
+	}
+	return HashFiles(t, opts)
+}
+
+// HashFiles computes both the torrent (SHA-1) and per-file (SHA-256) hashes
+// of the tree in a single pass. Unknown (-1) sizes of remote files are
+// filled in on t.Files.
+func HashFiles(t Tree, opts Options) ([]FileHashResult, TorrentPieces, error) {
+	if len(t.Files) == 0 {
+		return nil, TorrentPieces{}, fmt.Errorf("no files found under %s", t.Root)
+	}
+
+	pieceSize := opts.PieceSize
+	if pieceSize == 0 {
+		for _, fi := range t.Files {
+			if fi.Size < 0 {
+				return nil, TorrentPieces{}, fmt.Errorf("size of %s is unknown, so the piece size must be set", fi.RelPath)
+			}
+		}
+		pieceSize = CalculatePieceSize(t.Total)
+	}
+	if pieceSize < 16*1024 || pieceSize&(pieceSize-1) != 0 {
+		return nil, TorrentPieces{}, fmt.Errorf("piece size %d must be a power of two of at least 16 KiB", pieceSize)
+	}
+	readBuffer := opts.ReadBuffer
+	if readBuffer == 0 {
+		readBuffer = CHUNK_SIZE
+	}
+	if readBuffer < 0 {
+		return nil, TorrentPieces{}, errors.New("read buffer must be positive")
+	}
+
+	if opts.OnResult != nil && opts.Checkpoint != "" {
+		return nil, TorrentPieces{}, errors.New("a checkpoint needs every result, so it can't be combined with OnResult")
+	}
+
+	mh, err := newHasher(pieceSize, opts)
+	if err != nil {
+		return nil, TorrentPieces{}, err
+	}
+
+	// Hand the latest result over and forget its piece hashes
+	emit := func() error {
+		if opts.OnResult == nil {
+			return nil
+		}
+		r := &mh.results[len(mh.results)-1]
+		if r.Err == nil && !opts.NoSelfCheck {
+			if err := checkPieceCount(*r, pieceSize); err != nil {
+				return fmt.Errorf("self-check failed (this is a bug): %w", err)
+			}
+		}
+		if err := opts.OnResult(*r); err != nil {
+			return err
+		}
+		r.PieceHashes, r.SHA1PieceHashes, r.ExtraPieces = nil, nil, nil
+		return nil
+	}
+
+	startTime := time.Now()
+	total := t.Total // less the files that fail with KeepGoing
+	var totalBytesProcessed int64
+	var resumedBytes int64
+	var resumeFrom int
+	var resumeOffset int64 // into t.Files[resumeFrom]
+
+	if opts.Checkpoint != "" {
+		cp, err := readCheckpoint(opts.Checkpoint)
+		if err != nil {
+			return nil, TorrentPieces{}, fmt.Errorf("read checkpoint: %w", err)
+		}
+		if cp != nil {
+			if !sameFiles(cp.Files, t.Files) {
+				return nil, TorrentPieces{}, fmt.Errorf("checkpoint %s was made for a different set of files", opts.Checkpoint)
+			}
+			if err := mh.Restore(*cp); err != nil {
+				return nil, TorrentPieces{}, fmt.Errorf("restore checkpoint: %w", err)
+			}
+			resumeFrom = len(cp.Results)
+			for _, fi := range t.Files[:resumeFrom] {
+				totalBytesProcessed += fi.Size
+			}
+			if cp.Current != nil {
+				resumeOffset = cp.Current.Offset
+			}
+			resumedBytes = totalBytesProcessed + resumeOffset
+			if opts.Resume != nil {
+				opts.Resume(resumeFrom, resumedBytes)
+			}
+		}
+	}
+	// A failed save stops the run rather than failing the file being read
+	var saveErr error
+	mh.saveEvery, mh.lastSave = checkpointInterval, time.Now()
+
+	// Reuse buffer across all files
+	buf := make([]byte, readBuffer)
+
+	mh.tickEvery, mh.lastTick = opts.ProgressInterval, startTime
+	for i := resumeFrom; i < len(t.Files); i++ {
+		fi := t.Files[i]
+		var from int64
+		if i == resumeFrom && resumeOffset > 0 {
+			// Restore already put the hasher inside this file
+			from = resumeOffset
+		} else {
+			mh.StartFile(fi.RelPath)
+		}
+		if opts.Progress != nil && opts.ProgressInterval > 0 {
+			mh.tick = func() {
+				opts.Progress(Progress{
+					File:    fi,
+					Bytes:   totalBytesProcessed + mh.currentFileByteCount,
+					Files:   i,
+					Count:   len(t.Files),
+					Resumed: resumedBytes,
+					Total:   total,
+					Elapsed: time.Since(startTime),
+					Partial: true,
+				})
+			}
+		}
+		if fi.Placeholder || fi.Symlink != "" {
+			mh.EndFile()
+			if err := emit(); err != nil {
+				return nil, TorrentPieces{}, err
+			}
+			continue
+		}
+
+		mh.save = nil
+		if opts.Checkpoint != "" && fi.URL == "" {
+			mh.save = func() error {
+				cp := mh.Checkpoint(t.Files)
+				cp.Current, saveErr = mh.fileCheckpoint()
+				if saveErr == nil {
+					saveErr = writeCheckpoint(opts.Checkpoint, cp)
+				}
+				return saveErr
+			}
+		}
+
+		var n int64
+		var err error
+		if fi.URL != "" {
+			n, err = hashURL(opts.HTTPClient, mh, fi.URL, buf)
+		} else {
+			n, err = hashFile(mh, t, fi, buf, opts.SparseAware, from)
+		}
+		if saveErr != nil {
+			return nil, TorrentPieces{}, fmt.Errorf("write checkpoint: %w", saveErr)
+		}
+		// The torrent already has the size from the walk
+		if err == nil && fi.Size >= 0 && n != fi.Size {
+			err = fmt.Errorf("%s changed size from %d to %d bytes since it was listed", fi.RelPath, fi.Size, n)
+		}
+		if err != nil && !opts.KeepGoing {
+			return nil, TorrentPieces{}, err
+		}
+		if err != nil {
+			// Leave the file out of the torrent stream as if it weren't there
+			mh.discard(err)
+			total -= max(fi.Size, 0)
+		} else {
+			totalBytesProcessed += n
+			if fi.Size < 0 {
+				// Remote file of unknown size; the stream is authoritative
+				t.Files[i].Size = n
+			}
+			mh.EndFile()
+		}
+		if err := emit(); err != nil {
+			return nil, TorrentPieces{}, err
+		}
+
+		if opts.Checkpoint != "" && time.Since(mh.lastSave) > checkpointInterval {
+			if err := writeCheckpoint(opts.Checkpoint, mh.Checkpoint(t.Files)); err != nil {
+				return nil, TorrentPieces{}, fmt.Errorf("write checkpoint: %w", err)
+			}
+			mh.lastSave = time.Now()
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(Progress{
+				File:    fi,
+				Bytes:   totalBytesProcessed,
+				Files:   i + 1,
+				Count:   len(t.Files),
+				Resumed: resumedBytes,
+				Total:   total,
+				Elapsed: time.Since(startTime),
+				Err:     err,
+			})
+		}
+	}
+
+	mh.Finalize()
+
+	results := mh.GetResults()
+	pieces := TorrentPieces{PieceLength: pieceSize, Hashes: mh.GetTorrentPieces()}
+	if !opts.NoSelfCheck {
+		checked := t
+		checkedResults, _ := DropFailed(&checked, results)
+		if err := selfCheck(checked.Files, checkedResults, pieces.Hashes, pieceSize, opts.OnResult == nil); err != nil {
+			return nil, TorrentPieces{}, fmt.Errorf("self-check failed (this is a bug): %w", err)
+		}
+	}
+	return results, pieces, nil
+}
+
+// newHasher sets up a MultiHasher for the hash types in opts
+func newHasher(pieceSize int64, opts Options) (*MultiHasher, error) {
+	mh := NewMultiHasher(pieceSize)
+	mh.rewindable = opts.KeepGoing
+	mh.timings = opts.Timings
+	if opts.SHA1Pieces {
+		mh.EnableSHA1Pieces()
+	}
+	for _, l := range opts.ExtraPieceSizes {
+		if l < 16*1024 || l&(l-1) != 0 {
+			return nil, fmt.Errorf("extra piece size %d must be a power of two of at least 16 KiB", l)
+		}
+	}
+	mh.EnableExtraPieceSizes(opts.ExtraPieceSizes)
+	return mh, nil
+}
+
+// Verify hashes the files of t a second time and compares the outcome with
+// results and pieces from HashFiles, catching reads that returned wrong bytes
+// or files that changed while being hashed
+func Verify(t Tree, results []FileHashResult, pieces TorrentPieces, opts Options) error {
+	opts.PieceSize = pieces.PieceLength
+	opts.Checkpoint = ""
+	opts.KeepGoing = false
+	opts.NoSelfCheck = true
+	opts.Progress = nil
+	opts.Resume = nil
+	opts.Timings = nil
+
+	again, againPieces, err := HashFiles(t, opts)
+	if err != nil {
+		return err
+	}
+	if len(again) != len(results) {
+		return fmt.Errorf("hashed %d files, expected %d", len(again), len(results))
+	}
+	for i, r := range again {
+		first := results[i]
+		if r.RelPath != first.RelPath || r.Size != first.Size || r.FileSHA256 != first.FileSHA256 ||
+			!slices.Equal(r.PieceHashes, first.PieceHashes) || !slices.Equal(r.SHA1PieceHashes, first.SHA1PieceHashes) ||
+			!slices.EqualFunc(r.ExtraPieces, first.ExtraPieces, func(a, b ExtraPieceHashes) bool {
+				return a.Length == b.Length && slices.Equal(a.Hashes, b.Hashes)
+			}) {
+			return fmt.Errorf("%s: sha-256 %s on the second read, %s on the first", r.RelPath, r.FileSHA256, first.FileSHA256)
+		}
+	}
+	if !bytes.Equal(againPieces.Hashes, pieces.Hashes) {
+		return errors.New("torrent pieces differ on the second read")
+	}
+	return nil
+}
+
+// hashFile feeds fi through mh from the offset from, which a checkpoint has
+// already hashed, and returns the size read including from
+func hashFile(mh *MultiHasher, t Tree, fi FileInfo, buf []byte, sparse bool, from int64) (int64, error) {
+	f, full, err := t.open(fi)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Live directories lose files between the walk and the read
+		return 0, fmt.Errorf("%s was deleted after the walk listed it: %w", fi.RelPath, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if from > 0 {
+		if err := skip(f, from); err != nil {
+			return from, fmt.Errorf("resuming %s: %w", full, err)
+		}
+	}
+	if osFile, ok := f.(*os.File); ok && sparse {
+		n, ok, err := mh.copySparse(osFile, from, buf)
+		if err != nil {
+			return from + n, fmt.Errorf("reading %s: %w", full, err)
+		}
+		if ok {
+			return from + n, nil
+		}
+	}
+	n, err := mh.copyFrom(f, buf)
+	if err != nil {
+		return from + n, fmt.Errorf("reading %s: %w", full, err)
+	}
+	return from + n, nil
+}
+
+// skip moves f past its first n bytes, by seeking when f can
+func skip(f fs.File, n int64) error {
+	if s, ok := f.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekStart)
+		return err
+	}
+	m, err := io.CopyN(io.Discard, f, n)
+	if err == io.EOF {
+		return fmt.Errorf("file is %d bytes, shorter than the checkpoint", m)
+	}
+	return err
+}
+
+// open opens the local file fi from t.FS or disk, and returns the name to
+// use in errors
+func (t Tree) open(fi FileInfo) (fs.File, string, error) {
+	if t.FS != nil && fi.Source == "" {
+		f, err := t.FS.Open(fi.RelPath)
+		return f, fi.RelPath, err
+	}
+	full := t.FullPath(fi)
+	f, err := os.Open(full)
+	if err != nil {
+		// A nil *os.File must not become a non-nil fs.File
+		return nil, full, err
+	}
+	return f, full, nil
+}
+
+// SplitTree partitions the files of t, in their order, into consecutive
+// parts of at most maxSize bytes. Files are kept whole: a part is closed
+// when the next file would overflow it, and a file larger than maxSize gets a
+// part of its own. Every part keeps the root and name of t, so all parts
+// unpack into the same directory.
+func SplitTree(t Tree, maxSize int64) []Tree {
+	var parts []Tree
+	part := Tree{Root: t.Root, Name: t.Name, IsDir: t.IsDir, FS: t.FS}
+	for _, fi := range t.Files {
+		if len(part.Files) > 0 && part.Total+fi.Size > maxSize {
+			parts = append(parts, part)
+			part = Tree{Root: t.Root, Name: t.Name, IsDir: t.IsDir, FS: t.FS}
+		}
+		part.Files = append(part.Files, fi)
+		part.Total += fi.Size
+	}
+	if len(part.Files) > 0 {
+		parts = append(parts, part)
+	}
+	return parts
+}
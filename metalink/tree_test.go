@@ -0,0 +1,56 @@
+package metalink
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitTree(t *testing.T) {
+	tree := func(sizes ...int64) Tree {
+		tr := Tree{Root: "/data/set", Name: "set", IsDir: true}
+		for i, size := range sizes {
+			tr.Files = append(tr.Files, FileInfo{RelPath: string(rune('a' + i)), Size: size})
+			tr.Total += size
+		}
+		return tr
+	}
+
+	tests := []struct {
+		name  string
+		sizes []int64
+		want  [][]int64
+	}{
+		{"empty", nil, nil},
+		{"one part", []int64{30, 40, 30}, [][]int64{{30, 40, 30}}},
+		{"exact fill", []int64{60, 40, 100}, [][]int64{{60, 40}, {100}}},
+		{"overflow by one byte", []int64{60, 41, 10}, [][]int64{{60}, {41, 10}}},
+		{"larger than a part", []int64{10, 250, 10}, [][]int64{{10}, {250}, {10}}},
+		{"larger file first", []int64{250, 100}, [][]int64{{250}, {100}}},
+		{"empty files", []int64{100, 0, 0, 1}, [][]int64{{100, 0, 0}, {1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := tree(tt.sizes...)
+			parts := SplitTree(in, 100)
+			var got [][]int64
+			for _, part := range parts {
+				var sizes []int64
+				var total int64
+				for _, fi := range part.Files {
+					sizes = append(sizes, fi.Size)
+					total += fi.Size
+				}
+				got = append(got, sizes)
+				if part.Total != total {
+					t.Errorf("part total %d, expected %d", part.Total, total)
+				}
+				if part.Root != in.Root || part.Name != in.Name || part.IsDir != in.IsDir {
+					t.Errorf("part %q %q %t, expected %q %q %t", part.Root, part.Name, part.IsDir, in.Root, in.Name, in.IsDir)
+				}
+			}
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("SplitTree(%v, 100) = %v, want %v", tt.sizes, got, tt.want)
+			}
+		})
+	}
+}
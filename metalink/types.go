@@ -0,0 +1,169 @@
+package metalink
+
+import "encoding/xml"
+
+// ---------- Metalink (RFC5854) XML structs ----------
+
+type Metalink struct {
+	XMLName   xml.Name       `xml:"metalink"`
+	XMLNs     string         `xml:"xmlns,attr"`
+	Version   string         `xml:"version,attr,omitempty"`
+	Published string         `xml:"published,omitempty"` // RFC 3339
+	Metaurls  []MetaURL      `xml:"metaurl,omitempty"`
+	Files     []MetalinkFile `xml:"file"`
+
+	// With MetalinkOptions.RootHash, an extension element; see RootHash
+	RootHash *MetaHash `xml:"https://github.com/chapmanjacobd/mkmetalink root-hash,omitempty"`
+
+	Signature *MetaSignature `xml:"signature,omitempty"`
+}
+
+type MetaURL struct {
+	Priority  int    `xml:"priority,attr,omitempty"`
+	MediaType string `xml:"mediatype,attr,omitempty"`
+	Value     string `xml:",chardata"`
+}
+
+type MetalinkFile struct {
+	Name    string        `xml:"name,attr"`
+	Size    int64         `xml:"size"`
+	Version string        `xml:"version,omitempty"`
+	Hash    MetaHash      `xml:"hash"`
+	Pieces  []MetaPieces  `xml:"pieces,omitempty"`
+	URLs    []MetalinkURL `xml:"url,omitempty"`
+
+	ExternalPieces []ExternalPieces `xml:"https://github.com/chapmanjacobd/mkmetalink external-pieces,omitempty"`
+
+	// Content type hint, an extension element in the mkmetalink namespace
+	// since RFC 5854 has no per-file mediatype
+	MediaType string `xml:"https://github.com/chapmanjacobd/mkmetalink mediatype,omitempty"`
+
+	// Connection limit hint for the whole file, like the maxconnections
+	// attribute of Metalink 3 <resources>, which RFC 5854 dropped
+	MaxConnections int `xml:"https://github.com/chapmanjacobd/mkmetalink maxconnections,omitempty"`
+}
+
+type MetaHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type MetaPieces struct {
+	Type   string          `xml:"type,attr"`
+	Length int64           `xml:"length,attr"`
+	Hashes []MetaPieceHash `xml:"hash"`
+}
+
+// ExternalPieces replaces <pieces> with a reference to a sidecar file (see
+// ExternalizePieces). It is an extension element in the mkmetalink
+// namespace, so other clients ignore it.
+type ExternalPieces struct {
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr"`
+	Length int64  `xml:"length,attr"`
+	Offset int64  `xml:"offset,attr"` // of the first hash in bytes, after the magic line
+	Count  int    `xml:"count,attr"`
+}
+
+type MetaPieceHash struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type MetalinkURL struct {
+	Priority int    `xml:"priority,attr,omitempty"`
+	Value    string `xml:",chardata"`
+
+	// Connection limit hint for this mirror, like the Metalink 3 <url>
+	// attribute, in the mkmetalink namespace
+	MaxConnections int `xml:"https://github.com/chapmanjacobd/mkmetalink maxconnections,attr,omitempty"`
+}
+
+type MetaSignature struct {
+	Mediatype string `xml:"mediatype,attr"`
+	Value     string `xml:",chardata"`
+}
+
+// ---------- Torrent structures (bencode) ----------
+
+type Torrent struct {
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
+	URLList      []string    `bencode:"url-list,omitempty"`
+	CreationDate int64       `bencode:"creation date,omitempty"` // Unix seconds
+	Info         TorrentInfo `bencode:"info"`
+}
+
+type TorrentInfo struct {
+	PieceLength int64             `bencode:"piece length"`
+	Pieces      string            `bencode:"pieces"`              // required by BEP 3, even when empty
+	RootHash    string            `bencode:"root hash,omitempty"` // BEP-30 merkle torrents; see merkleInfo
+	Name        string            `bencode:"name"`
+	Length      int64             `bencode:"length,omitempty"`
+	Files       []TorrentFileInfo `bencode:"files,omitempty"`
+	Attr        string            `bencode:"attr,omitempty"` // BEP-47, "x" for an executable single file
+
+	NameUTF8 string `bencode:"name.utf-8,omitempty"` // copy of Name for clients that predate UTF-8 names
+}
+
+// merkleTorrent and merkleInfo are Torrent and TorrentInfo as written for
+// BEP-30 merkle torrents, which carry the root hash instead of the pieces
+// key that every other torrent must have
+type merkleTorrent struct {
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	URLList      []string   `bencode:"url-list,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	Info         merkleInfo `bencode:"info"`
+}
+
+type merkleInfo struct {
+	PieceLength int64             `bencode:"piece length"`
+	RootHash    string            `bencode:"root hash"`
+	Name        string            `bencode:"name"`
+	Length      int64             `bencode:"length,omitempty"`
+	Files       []TorrentFileInfo `bencode:"files,omitempty"`
+	Attr        string            `bencode:"attr,omitempty"`
+	NameUTF8    string            `bencode:"name.utf-8,omitempty"`
+}
+
+// encoded returns what is bencoded for t, a merkleTorrent when it has a root
+// hash
+func (t Torrent) encoded() any {
+	if t.Info.RootHash == "" {
+		return t
+	}
+	return merkleTorrent{
+		Announce:     t.Announce,
+		AnnounceList: t.AnnounceList,
+		URLList:      t.URLList,
+		CreationDate: t.CreationDate,
+		Info:         t.Info.encoded().(merkleInfo),
+	}
+}
+
+// encoded returns what is bencoded for info, a merkleInfo when it has a root
+// hash
+func (info TorrentInfo) encoded() any {
+	if info.RootHash == "" {
+		return info
+	}
+	return merkleInfo{
+		PieceLength: info.PieceLength,
+		RootHash:    info.RootHash,
+		Name:        info.Name,
+		Length:      info.Length,
+		Files:       info.Files,
+		Attr:        info.Attr,
+		NameUTF8:    info.NameUTF8,
+	}
+}
+
+type TorrentFileInfo struct {
+	Length      int64    `bencode:"length"`
+	Path        []string `bencode:"path"`
+	Attr        string   `bencode:"attr,omitempty"`         // BEP-47, "l" for a symlink or "x" for an executable
+	SymlinkPath []string `bencode:"symlink path,omitempty"` // BEP-47, relative to the torrent root
+
+	PathUTF8 []string `bencode:"path.utf-8,omitempty"` // copy of Path, as TorrentInfo.NameUTF8
+}
@@ -0,0 +1,158 @@
+package metalink
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// pieceJob is one per-file piece for VerifyParallel
+type pieceJob struct {
+	file  int
+	piece int
+}
+
+// VerifyParallel checks the files of t against the per-file piece hashes in
+// results, reading the pieces at their offsets with ReadAt from workers
+// goroutines. Unlike Verify, which re-hashes everything in order, this keeps
+// fast storage busy. Each mismatch or read error is passed to onFailure as
+// soon as it is found. The whole-file hashes aren't recomputed, but the
+// pieces cover every byte. Remote files can't be read at offsets and are
+// refused.
+func VerifyParallel(t Tree, results []FileHashResult, pieceLength int64, workers int, onFailure func(error)) error {
+	if workers < 1 {
+		return errors.New("need at least one worker")
+	}
+	if pieceLength <= 0 {
+		return fmt.Errorf("piece length %d is not positive", pieceLength)
+	}
+	if len(results) != len(t.Files) {
+		return fmt.Errorf("%d results for %d files", len(results), len(t.Files))
+	}
+	for i, fi := range t.Files {
+		if results[i].RelPath != fi.RelPath {
+			return fmt.Errorf("result %d is for %s, not %s", i, results[i].RelPath, fi.RelPath)
+		}
+		if fi.URL != "" {
+			return fmt.Errorf("%s is remote and can't be verified in parallel", fi.URL)
+		}
+	}
+
+	jobs := make(chan pieceJob)
+	var mu sync.Mutex
+	failures := 0
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures++
+		if onFailure != nil {
+			onFailure(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pv := pieceVerifier{t: t, buf: make([]byte, pieceLength), current: -1}
+			defer pv.close()
+			for job := range jobs {
+				if err := pv.check(job, results[job.file], pieceLength); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	for i, fi := range t.Files {
+		if fi.Placeholder || fi.Symlink != "" {
+			continue
+		}
+		r := results[i]
+		if want := (r.Size + pieceLength - 1) / pieceLength; int64(len(r.PieceHashes)) != want {
+			fail(fmt.Errorf("%s: %d piece hashes for %d bytes, expected %d", fi.RelPath, len(r.PieceHashes), r.Size, want))
+			continue
+		}
+		for piece := range r.PieceHashes {
+			jobs <- pieceJob{file: i, piece: piece}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if failures > 0 {
+		return fmt.Errorf("%d pieces or files failed verification", failures)
+	}
+	return nil
+}
+
+// pieceVerifier is a worker's state. Workers mostly get consecutive pieces
+// of the same file, so the file stays open between them.
+type pieceVerifier struct {
+	t       Tree
+	buf     []byte
+	current int
+	f       fs.File
+	name    string
+}
+
+func (pv *pieceVerifier) check(job pieceJob, r FileHashResult, pieceLength int64) error {
+	if job.file != pv.current {
+		pv.close()
+		pv.current = job.file
+		f, name, err := pv.t.open(pv.t.Files[job.file])
+		if err != nil {
+			return err
+		}
+		pv.f, pv.name = f, name
+		info, err := f.Stat()
+		if err == nil && info.Size() != r.Size {
+			err = fmt.Errorf("%s: %d bytes now, %d on the first read", r.RelPath, info.Size(), r.Size)
+		}
+		if err != nil {
+			pv.close()
+			return err
+		}
+	}
+	if pv.f == nil {
+		// Already reported for an earlier piece
+		return nil
+	}
+	ra, ok := pv.f.(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("%s can't be read at an offset", pv.name)
+	}
+
+	offset := int64(job.piece) * pieceLength
+	data := pv.buf[:min(pieceLength, r.Size-offset)]
+	if _, err := ra.ReadAt(data, offset); err != nil {
+		return fmt.Errorf("reading %s at %d: %w", pv.name, offset, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != r.PieceHashes[job.piece] {
+		return fmt.Errorf("%s: piece %d differs from the first read", r.RelPath, job.piece)
+	}
+	if job.piece < len(r.SHA1PieceHashes) {
+		sum := sha1.Sum(data)
+		if hex.EncodeToString(sum[:]) != r.SHA1PieceHashes[job.piece] {
+			return fmt.Errorf("%s: sha-1 piece %d differs from the first read", r.RelPath, job.piece)
+		}
+	}
+	return nil
+}
+
+// close closes the file. current is kept so that a file that failed to
+// open isn't retried for each of its pieces.
+func (pv *pieceVerifier) close() {
+	if pv.f != nil {
+		pv.f.Close()
+		pv.f = nil
+	}
+}
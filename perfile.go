@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/chapmanjacobd/mkmetalink/metalink"
+)
+
+// perFileDir is where --per-file-metalinks go, laid out like the package
+func (c *GenerateCmd) perFileDir(name string) string {
+	return filepath.Join(c.metaOutDir(), name+".metalinks")
+}
+
+// writePerFileMetalinks writes a metalink for each file of meta to
+// <dir>/<relpath>.meta4, to be published next to the file. Each lists the
+// file under its base name, where a client saves it, with the hashes and
+// mirror URLs of the combined metalink but no torrent, which would fetch
+// the whole package.
+func (c *GenerateCmd) writePerFileMetalinks(dir string, tree metalink.Tree, meta metalink.Metalink) (int, error) {
+	prefix := ""
+	if tree.IsDir && !c.NoWrap {
+		prefix = tree.Name + "/"
+	}
+	for _, mf := range meta.Files {
+		relPath := strings.TrimPrefix(mf.Name, prefix)
+		mf.Name = path.Base(relPath)
+		doc := metalink.Metalink{
+			XMLNs:     meta.XMLNs,
+			Version:   meta.Version,
+			Published: meta.Published,
+			Files:     []metalink.MetalinkFile{mf},
+		}
+
+		p := filepath.Join(dir, filepath.FromSlash(relPath)+".meta4")
+		if err := c.mkdirOut(filepath.Dir(p)); err != nil {
+			return 0, err
+		}
+		if err := c.writeMeta(p, doc); err != nil {
+			return 0, fmt.Errorf("%s: %w", relPath, err)
+		}
+		if c.signsMetalink() {
+			if err := c.sign(p, &doc); err != nil {
+				return 0, fmt.Errorf("%s: %w", relPath, err)
+			}
+		}
+	}
+	return len(meta.Files), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"runtime/trace"
+	"time"
+
+	"github.com/chapmanjacobd/mkmetalink/metalink"
+)
+
+// startProfiling starts --cpuprofile and --trace. The returned function stops
+// them and must be called before exiting.
+func (c *GenerateCmd) startProfiling() (func(), error) {
+	var stops []func()
+	stop := func() {
+		for _, s := range stops {
+			s()
+		}
+	}
+
+	if c.CPUProfile != "" {
+		f, err := os.Create(c.CPUProfile)
+		if err != nil {
+			return stop, fmt.Errorf("cpuprofile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return stop, fmt.Errorf("cpuprofile: %w", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+	if c.Trace != "" {
+		f, err := os.Create(c.Trace)
+		if err != nil {
+			return stop, fmt.Errorf("trace: %w", err)
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return stop, fmt.Errorf("trace: %w", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+	return stop, nil
+}
+
+// phaseTimings records the wall time between marks for --timings, so the
+// phases add up to the whole run
+type phaseTimings struct {
+	names []string
+	times []time.Duration
+	last  time.Time
+
+	hashing metalink.Timings // read and hash time within the hashing phase
+}
+
+func newPhaseTimings() *phaseTimings {
+	return &phaseTimings{last: time.Now()}
+}
+
+// mark ends the phase called name
+func (pt *phaseTimings) mark(name string) {
+	now := time.Now()
+	pt.names = append(pt.names, name)
+	pt.times = append(pt.times, now.Sub(pt.last))
+	pt.last = now
+}
+
+func (pt *phaseTimings) print() {
+	fmt.Printf("\nTimings:\n")
+	var total time.Duration
+	for i, name := range pt.names {
+		d := pt.times[i]
+		total += d
+		fmt.Printf("  %-16s %8.3fs", name, d.Seconds())
+		if name == "hashing" {
+			other := d - pt.hashing.Read - pt.hashing.Hash
+			fmt.Printf("  (read %.3fs, hash %.3fs, other %.3fs)", pt.hashing.Read.Seconds(), pt.hashing.Hash.Seconds(), other.Seconds())
+		}
+		fmt.Println()
+	}
+	fmt.Printf("  %-16s %8.3fs\n", "total", total.Seconds())
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing/fstest"
+
+	"github.com/chapmanjacobd/mkmetalink/metalink"
+)
+
+type SelftestCmd struct {
+	Keep bool `help:"Keep the temporary directory for inspection"`
+}
+
+// selftestPieceSize is small so that the synthetic tree spans many pieces
+const selftestPieceSize = 16 * 1024
+
+// selftestTree returns deterministic file contents keyed by relative path.
+// Sizes sit on either side of piece boundaries.
+func selftestTree() map[string][]byte {
+	sizes := map[string]int{
+		"a/empty":            0,
+		"a/one":              1,
+		"a/piece-minus-one":  selftestPieceSize - 1,
+		"b/c/piece-plus-one": selftestPieceSize + 1,
+		"b/exact":            selftestPieceSize,
+		"café déjà #1.bin":   5,
+		"multi.bin":          3*selftestPieceSize + 17,
+	}
+
+	tree := make(map[string][]byte)
+	for name, size := range sizes {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		tree[name] = data
+	}
+	return tree
+}
+
+func (c *SelftestCmd) Run() error {
+	dir, err := os.MkdirTemp("", "mkmetalink-selftest-")
+	if err != nil {
+		return err
+	}
+	if c.Keep {
+		fmt.Printf("Keeping %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	tree := selftestTree()
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	src := filepath.Join(dir, "tree")
+	for _, name := range names {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, tree[name], 0o644); err != nil {
+			return err
+		}
+	}
+
+	out := filepath.Join(dir, "out")
+	gen := GenerateCmd{
+		Path:    src,
+		OutDir:  out,
+		Tracker: "https://tracker.example.com/announce",
+		Mirrors: []string{"https://example.com/pub/"},
+		// An odd buffer size makes reads straddle piece boundaries
+		PieceSize:  selftestPieceSize,
+		ReadBuffer: 10007,
+		SizeUnits:  "iec",
+		SignTarget: "metalink",
+		PieceHash:  []string{"sha-256", "sha-1"},
+	}
+	if err := gen.Run(); err != nil {
+		return fmt.Errorf("generate: %w", err)
+	}
+
+	meta, err := metalink.ReadMetaFile(filepath.Join(out, "tree.meta4"))
+	if err != nil {
+		return fmt.Errorf("parse meta4: %w", err)
+	}
+	tor, err := metalink.ReadTorrentFile(filepath.Join(out, "tree.torrent"))
+	if err != nil {
+		return fmt.Errorf("parse torrent: %w", err)
+	}
+
+	if err := checkSelftestMetalink(meta, tree, names); err != nil {
+		return fmt.Errorf("meta4: %w", err)
+	}
+	if err := checkSelftestTorrent(tor, tree, names); err != nil {
+		return fmt.Errorf("torrent: %w", err)
+	}
+	if err := checkSelftestFS(tor, tree); err != nil {
+		return fmt.Errorf("fs: %w", err)
+	}
+
+	fmt.Printf("\nselftest: ok (%d files)\n", len(names))
+	return nil
+}
+
+func checkSelftestMetalink(meta metalink.Metalink, tree map[string][]byte, names []string) error {
+	if len(meta.Files) != len(names) {
+		return fmt.Errorf("%d files, expected %d", len(meta.Files), len(names))
+	}
+
+	for i, name := range names {
+		mf := meta.Files[i]
+		data := tree[name]
+		if mf.Name != "tree/"+name {
+			return fmt.Errorf("file %d is named %q, expected %q", i, mf.Name, "tree/"+name)
+		}
+		if mf.Size != int64(len(data)) {
+			return fmt.Errorf("%s: size %d, expected %d", name, mf.Size, len(data))
+		}
+
+		sum := sha256.Sum256(data)
+		if mf.Hash.Type != "sha-256" || mf.Hash.Value != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("%s: wrong file hash %s %s", name, mf.Hash.Type, mf.Hash.Value)
+		}
+
+		if len(mf.Pieces) != 2 || mf.Pieces[0].Type != "sha-256" || mf.Pieces[1].Type != "sha-1" {
+			return fmt.Errorf("%s: expected sha-256 and sha-1 piece hashes", name)
+		}
+		for _, p := range mf.Pieces {
+			if p.Length != selftestPieceSize {
+				return fmt.Errorf("%s: %s piece length %d, expected %d", name, p.Type, p.Length, selftestPieceSize)
+			}
+			var want []string
+			for off := 0; off < len(data); off += selftestPieceSize {
+				piece := data[off:min(off+selftestPieceSize, len(data))]
+				if p.Type == "sha-1" {
+					sum := sha1.Sum(piece)
+					want = append(want, hex.EncodeToString(sum[:]))
+				} else {
+					sum := sha256.Sum256(piece)
+					want = append(want, hex.EncodeToString(sum[:]))
+				}
+			}
+			if len(p.Hashes) != len(want) {
+				return fmt.Errorf("%s: %d %s piece hashes, expected %d", name, len(p.Hashes), p.Type, len(want))
+			}
+			for j, h := range p.Hashes {
+				if h.Value != want[j] {
+					return fmt.Errorf("%s: %s piece %d is %s, expected %s", name, p.Type, j, h.Value, want[j])
+				}
+			}
+		}
+
+		wantURL, err := metalink.JoinMirrorURL("https://example.com/pub/", "tree/"+name)
+		if err != nil {
+			return err
+		}
+		if len(mf.URLs) != 1 || mf.URLs[0].Value != wantURL {
+			return fmt.Errorf("%s: urls %v, expected %s", name, mf.URLs, wantURL)
+		}
+	}
+
+	// Names are escaped segment by segment, never left raw
+	last := meta.Files[slices.Index(names, "café déjà #1.bin")]
+	if want := "https://example.com/pub/tree/caf%C3%A9%20d%C3%A9j%C3%A0%20%231.bin"; last.URLs[0].Value != want {
+		return fmt.Errorf("url %s, expected %s", last.URLs[0].Value, want)
+	}
+	return nil
+}
+
+// checkSelftestFS hashes the tree from memory through WalkFS, which must
+// give the same pieces as the files on disk
+func checkSelftestFS(tor metalink.Torrent, tree map[string][]byte) error {
+	fsys := fstest.MapFS{}
+	for name, data := range tree {
+		fsys[name] = &fstest.MapFile{Data: data, Mode: 0o644}
+	}
+	t, err := metalink.WalkFS(fsys, "tree", metalink.Options{})
+	if err != nil {
+		return err
+	}
+	_, pieces, err := metalink.HashFiles(t, metalink.Options{PieceSize: selftestPieceSize})
+	if err != nil {
+		return err
+	}
+	if string(pieces.Hashes) != tor.Info.Pieces {
+		return errors.New("pieces differ from those of the files on disk")
+	}
+	return nil
+}
+
+func checkSelftestTorrent(tor metalink.Torrent, tree map[string][]byte, names []string) error {
+	if tor.Info.Name != "tree" {
+		return fmt.Errorf("name %q, expected %q", tor.Info.Name, "tree")
+	}
+	if tor.Info.PieceLength != selftestPieceSize {
+		return fmt.Errorf("piece length %d, expected %d", tor.Info.PieceLength, selftestPieceSize)
+	}
+	if len(tor.Info.Files) != len(names) {
+		return fmt.Errorf("%d files, expected %d", len(tor.Info.Files), len(names))
+	}
+
+	var stream []byte
+	for i, name := range names {
+		tf := tor.Info.Files[i]
+		if strings.Join(tf.Path, "/") != name {
+			return fmt.Errorf("file %d has path %v, expected %s", i, tf.Path, name)
+		}
+		if tf.Length != int64(len(tree[name])) {
+			return fmt.Errorf("%s: length %d, expected %d", name, tf.Length, len(tree[name]))
+		}
+		stream = append(stream, tree[name]...)
+	}
+
+	// Torrent pieces run across file boundaries
+	var want bytes.Buffer
+	for off := 0; off < len(stream); off += selftestPieceSize {
+		sum := sha1.Sum(stream[off:min(off+selftestPieceSize, len(stream))])
+		want.Write(sum[:])
+	}
+	if tor.Info.Pieces != want.String() {
+		return fmt.Errorf("pieces differ (%d bytes, expected %d)", len(tor.Info.Pieces), want.Len())
+	}
+
+	if len(tor.URLList) != 1 || tor.URLList[0] != "https://example.com/pub/" {
+		return fmt.Errorf("url-list %v", tor.URLList)
+	}
+	return nil
+}
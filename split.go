@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/chapmanjacobd/mkmetalink/metalink"
+)
+
+// runSplit generates each --split-size part of tree as <name>.partN, with the
+// numbers zero-padded so the parts sort in order
+func (c *GenerateCmd) runSplit(tree metalink.Tree) error {
+	if !tree.IsDir {
+		return errors.New("split-size needs a directory or several URLs")
+	}
+	parts := metalink.SplitTree(tree, int64(c.SplitSize))
+	width := len(fmt.Sprint(len(parts)))
+
+	sizeBase := 1024.0
+	if c.SizeUnits == "si" {
+		sizeBase = 1000
+	}
+	var names []string
+	var keptGoing error
+	for i := range parts {
+		part := &parts[i]
+		if len(part.Files) == 1 && part.Total > int64(c.SplitSize) {
+			log.Printf("warning: %s is larger than --split-size and makes up a part of its own", part.Files[0].RelPath)
+		}
+
+		sub := *c
+		sub.part = part
+		sub.partName = fmt.Sprintf("%s.part%0*d", tree.Name, width, i+1)
+		// Profiling covers the whole run already
+		sub.CPUProfile, sub.Trace = "", ""
+		fmt.Printf("\n%s:\n", sub.partName)
+		if err := sub.Run(); err != nil {
+			err = fmt.Errorf("%s: %w", sub.partName, err)
+			if !c.KeepGoing {
+				return err
+			}
+			// The part was written without its unreadable files
+			keptGoing = errors.Join(keptGoing, err)
+		}
+		names = append(names, sub.partName)
+	}
+
+	fmt.Printf("\nSplit %s into %d parts:\n", tree.Name, len(parts))
+	for i, name := range names {
+		fmt.Printf("  %s  %d files  %s\n", name, len(parts[i].Files), metalink.FormatBytes(parts[i].Total, sizeBase))
+	}
+
+	indexPath, err := c.writeIndex(tree.Name, names)
+	if err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+	fmt.Printf("\nIndex:\n%s\n", indexPath)
+	return keptGoing
+}
+
+// writeIndex writes <name>.index.meta4, a metalink whose files are the
+// metalinks and torrents of the parts, so that one download leads to all of
+// them. It is built like any other metalink, from a tree of the artifacts.
+func (c *GenerateCmd) writeIndex(name string, parts []string) (string, error) {
+	metaDir := c.metaOutDir()
+	index := metalink.Tree{Root: metaDir, Name: name, IsDir: true}
+	add := func(p string) error {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		index.Files = append(index.Files, metalink.FileInfo{RelPath: filepath.Base(p), Size: info.Size(), Source: p})
+		index.Total += info.Size()
+		return nil
+	}
+	for _, part := range parts {
+		artifacts := []string{filepath.Join(metaDir, part+".meta4")}
+		if c.ExternalPieces {
+			artifacts = append(artifacts, filepath.Join(metaDir, part+".pieces"))
+		}
+		if !c.HTTPOnly {
+			artifacts = append(artifacts, filepath.Join(c.torrentOutDir(), part+c.torrentExt()))
+		}
+		for _, p := range artifacts {
+			if err := add(p); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	results, _, err := metalink.HashFiles(index, metalink.Options{NoSelfCheck: true, Logf: log.Printf})
+	if err != nil {
+		return "", err
+	}
+	var mirrors []string
+	if c.IndexURL != "" {
+		mirrors = []string{c.IndexURL}
+	}
+	meta, err := metalink.BuildMetalink(index, results, metalink.CalculatePieceSize(index.Total), metalink.MetalinkOptions{
+		Mirrors: mirrors,
+		NoWrap:  true,
+		// Artifacts are small enough to be checked whole
+		NoPieces: true,
+		Logf:     log.Printf,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	indexPath := filepath.Join(metaDir, name+".index.meta4")
+	if err := c.writeMeta(indexPath, meta); err != nil {
+		return "", err
+	}
+	if c.signsMetalink() {
+		if err := c.sign(indexPath, &meta); err != nil {
+			return "", err
+		}
+	}
+	return indexPath, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+
+	"github.com/chapmanjacobd/mkmetalink/metalink"
+)
+
+// updateFile re-hashes one file of tree and patches its size, hash and
+// pieces in the existing metalink. The torrent can't be patched this way
+// because its SHA-1 pieces span file boundaries.
+func (c *GenerateCmd) updateFile(tree metalink.Tree, opts metalink.Options) error {
+	if len(c.URL) > 0 {
+		return errors.New("update-file only works with a local path")
+	}
+	relPath := path.Clean(filepath.ToSlash(c.UpdateFile))
+	if !tree.IsDir {
+		relPath = tree.Files[0].RelPath
+	}
+
+	sub := tree
+	sub.Files = nil
+	for _, fi := range tree.Files {
+		if fi.RelPath == relPath {
+			sub.Files = append(sub.Files, fi)
+			sub.Total = fi.Size
+		}
+	}
+	if len(sub.Files) == 0 {
+		return fmt.Errorf("update-file: %s is not in %s", relPath, c.Path)
+	}
+
+	metaPath := filepath.Join(c.metaOutDir(), tree.Name+".meta4")
+	meta, err := metalink.ReadMetaFile(metaPath)
+	if err != nil {
+		return fmt.Errorf("update-file: %w", err)
+	}
+
+	name := relPath
+	if tree.IsDir && !c.NoWrap {
+		name = tree.Name + "/" + relPath
+	}
+	idx := -1
+	for i, mf := range meta.Files {
+		if mf.Name == name {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("update-file: %s has no entry named %s (was it generated with the same --no-wrap setting?)", metaPath, name)
+	}
+	old := meta.Files[idx]
+	if len(old.ExternalPieces) > 0 {
+		return fmt.Errorf("update-file: %s keeps its piece hashes in %s, which can't be patched; regenerate both", metaPath, old.ExternalPieces[0].Href)
+	}
+
+	// Keep the piece length and hash types of the existing metalink
+	pieceSize := metalink.CalculatePieceSize(tree.Total)
+	var pieceTypes []string
+	opts.ExtraPieceSizes = nil
+	for i, p := range old.Pieces {
+		if i > 0 && p.Length != old.Pieces[0].Length {
+			// Listed with --extra-piece-size
+			opts.ExtraPieceSizes = append(opts.ExtraPieceSizes, p.Length)
+			continue
+		}
+		pieceSize = p.Length
+		pieceTypes = append(pieceTypes, p.Type)
+		opts.SHA1Pieces = opts.SHA1Pieces || p.Type == "sha-1"
+	}
+	opts.PieceSize = pieceSize
+	opts.Checkpoint = ""
+
+	results, _, err := metalink.HashFiles(sub, opts)
+	if err != nil {
+		return err
+	}
+	updated, err := metalink.BuildMetalink(sub, results, pieceSize, metalink.MetalinkOptions{
+		NoWrap:   c.NoWrap,
+		NoPieces: len(old.Pieces) == 0,
+
+		PieceHashTypes: pieceTypes,
+		Logf:           log.Printf,
+	})
+	if err != nil {
+		return err
+	}
+
+	mf := updated.Files[0]
+	if old.Size == mf.Size && old.Hash == mf.Hash {
+		fmt.Printf("%s is unchanged\n", relPath)
+		return nil
+	}
+	meta.Files[idx].Size = mf.Size
+	meta.Files[idx].Hash = mf.Hash
+	meta.Files[idx].Pieces = mf.Pieces
+	if meta.RootHash != nil {
+		root, err := metalink.RootHash(meta.Files)
+		if err != nil {
+			return fmt.Errorf("update-file: %w", err)
+		}
+		meta.RootHash.Value = root
+	}
+
+	// The old signature no longer matches
+	meta.Signature = nil
+	if err := c.writeMeta(metaPath, meta); err != nil {
+		return fmt.Errorf("write meta4: %w", err)
+	}
+	if c.signsMetalink() {
+		if err := c.sign(metaPath, &meta); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Updated %s in:\n%s\n", relPath, metaPath)
+	log.Printf("warning: %s is now out of date; regenerate it to include the new %s", tree.Name+c.torrentExt(), relPath)
+	return nil
+}